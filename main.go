@@ -9,17 +9,26 @@ package main
 
 import (
 	"C"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/kobsio/klogs/pkg/clickhouse"
+	"github.com/kobsio/klogs/pkg/decoder"
+	"github.com/kobsio/klogs/pkg/filter"
 	"github.com/kobsio/klogs/pkg/flatten"
 	"github.com/kobsio/klogs/pkg/instrument/logger"
 	"github.com/kobsio/klogs/pkg/instrument/metrics"
+	"github.com/kobsio/klogs/pkg/mapping"
+	"github.com/kobsio/klogs/pkg/redact"
+	"github.com/kobsio/klogs/pkg/router"
+	"github.com/kobsio/klogs/pkg/timestamp"
 	"github.com/kobsio/klogs/pkg/version"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -30,49 +39,192 @@ import (
 const (
 	defaultMetricsServerAddress string        = ":2021"
 	defaultDatabase             string        = "logs"
+	defaultTable                string        = "logs"
 	defaultDialTimeout          string        = "10s"
 	defaultConnMaxLifetime      string        = "1h"
 	defaultMaxIdleConns         int           = 1
 	defaultMaxOpenConns         int           = 1
+	defaultInsertMode           string        = clickhouse.InsertModeBatch
 	defaultBatchSize            int64         = 10000
 	defaultFlushInterval        time.Duration = 60 * time.Second
 	defaultForceUnderscores     bool          = false
+	defaultWALMaxSize           int64         = 1024 * 1024 * 1024
+	defaultMaxAttempts          int           = 10
+	defaultRetryBackoff         time.Duration = 1 * time.Second
+	defaultRetryMaxBackoff      time.Duration = 5 * time.Minute
+	defaultMaxBufferSize        int           = 0
+	defaultMaxBufferBytes       int64         = 0
+	defaultOverflowPolicy       string        = clickhouse.OverflowPolicyRetry
+	defaultCompression          string        = clickhouse.CompressionNone
+	defaultCompressionLevel     int           = 0
+	defaultProtocol             string        = clickhouse.ProtocolNative
+	defaultSchemaVerify         string        = clickhouse.SchemaVerifyWarn
+	defaultStorageLayout        string        = clickhouse.StorageLayoutClassic
+	defaultTimeFallback         string        = timestamp.FallbackEventTime
+	defaultKeySeparator         string        = flatten.DefaultSeparator
+	defaultKeyReplacement       string        = "_"
+	defaultKeyMaxLength         int           = 0
+	defaultMaxDepth             int           = 0
+	defaultMaxFields            int           = 0
+	defaultMaxValueLength       int           = 0
 )
 
 var (
-	database          string
-	batchSize         int64
-	flushInterval     time.Duration
-	forceNumberFields []string
-	forceUnderscores  bool
-	lastFlush         = time.Now()
-	client            *clickhouse.Client
-	metricsServer     metrics.Server
+	// instanceCount is the number of plugin instances which were initialized.
+	// It is used to generate a unique name for each instance, when the user
+	// doesn't provide one via the "instance_name" configuration key.
+	instanceCount int
 
-	inputRecordsTotalMetric = promauto.NewCounter(prometheus.CounterOpts{
+	// metricsServer is shared by all plugin instances, because all instances
+	// are running in the same process and are using the same Prometheus
+	// registry. The server is started by the first instance and stopped when
+	// the last instance exits.
+	metricsServer      metrics.Server
+	metricsServerRefs  int
+	metricsServerMutex sync.Mutex
+
+	inputRecordsTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "klogs",
 		Name:      "input_records_total",
 		Help:      "Number of received records.",
-	})
-	errorsTotalMetric = promauto.NewCounter(prometheus.CounterOpts{
+	}, []string{"instance"})
+	errorsTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "klogs",
 		Name:      "errors_total",
 		Help:      "Number of errors when writing records to ClickHouse",
-	})
-	batchSizeMetric = promauto.NewSummary(prometheus.SummaryOpts{
+	}, []string{"instance"})
+	batchSizeMetric = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace:  "klogs",
 		Name:       "batch_size",
 		Help:       "The number of records which are written to ClickHouse.",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.95: 0.005, 0.99: 0.001},
-	})
-	flushTimeSecondsMetric = promauto.NewSummary(prometheus.SummaryOpts{
+	}, []string{"instance"})
+	timeParseFailuresTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "time_parse_failures_total",
+		Help:      "Number of records, where the time field could not be parsed.",
+	}, []string{"instance"})
+	clippedRecordsTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "clipped_records_total",
+		Help:      "Number of records, which exceeded the maximum depth, number of fields or length of values.",
+	}, []string{"instance", "limit"})
+	droppedKeysTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "dropped_keys_total",
+		Help:      "Number of keys, which were dropped by the include and exclude fields.",
+	}, []string{"instance"})
+	redactionsTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "redactions_total",
+		Help:      "Number of values, which were redacted by a redaction rule.",
+	}, []string{"instance", "rule"})
+	flushTimeSecondsMetric = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace:  "klogs",
 		Name:       "flush_time_seconds",
 		Help:       "The time needed to write the records in seconds.",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.95: 0.005, 0.99: 0.001},
-	})
+	}, []string{"instance"})
 )
 
+// instance contains the configuration and the ClickHouse client for a single
+// output instance of the plugin. Fluent Bit allows multiple "[OUTPUT]" sections
+// which are using the same plugin, so that we can not use package level
+// variables for the state. Instead a new instance is created for each output in
+// FLBPluginInit and registered as context, so that it can be retrieved in
+// FLBPluginFlushCtx and FLBPluginExitCtx.
+type instance struct {
+	name              string
+	logger            *slog.Logger
+	batchSize         int64
+	flushInterval     time.Duration
+	forceNumberFields []string
+	forceUnderscores  bool
+	overflowPolicy    string
+	lastFlush         time.Time
+	router            *router.Router
+	mapping           *mapping.Mapping
+	client            *clickhouse.Client
+
+	// columns are the dedicated columns for fields of a record. If
+	// removeColumnFields is true, the fields of the dedicated columns are not
+	// added to the fields_string and fields_number maps.
+	columns            []clickhouse.Column
+	columnKeys         map[string]struct{}
+	removeColumnFields bool
+
+	// filter decides which flattened keys of a record are added to the
+	// fields_string and fields_number maps, based on the include and exclude
+	// fields.
+	filter *filter.Filter
+
+	// redactor masks, hashes or drops sensitive data in the log line and the
+	// fields of a row, before the row is added to the buffer.
+	redactor *redact.Redactor
+
+	// metadataPrefix is the key under which the metadata of a record is added
+	// to the fields of the record. If it is empty, the metadata is discarded.
+	metadataPrefix string
+
+	// flattenOptions are the options to flatten the nested fields of a record.
+	flattenOptions flatten.Options
+
+	// fields defines if boolean values are written to the fields_bool column
+	// and if arrays are kept intact and written to the fields_array column,
+	// instead of writing them to the fields_string map.
+	fields clickhouse.FieldsOptions
+
+	// storageLayout defines if the flattened fields of a record are written to
+	// the fields_string and fields_number columns or if the nested record is
+	// written to the fields column. For the json storage layout only the
+	// lookupKeys are looked up in the nested record.
+	storageLayout string
+	lookupKeys    []string
+
+	// timeKey is the field, which is used as timestamp of a row instead of the
+	// event time of Fluent Bit. If the field is missing or can not be parsed by
+	// the timeParser, the timeFallback policy is applied.
+	timeKey      string
+	timeParser   *timestamp.Parser
+	timeFallback string
+
+	// writeMutex ensures that the buffer is never written concurrently by the
+	// flush callback and the background flusher. The done channel is closed
+	// when the plugin exits, to stop the background flusher.
+	writeMutex *sync.Mutex
+	done       chan struct{}
+	wg         *sync.WaitGroup
+}
+
+// startMetricsServer starts the shared metrics server, when it isn't already
+// running. The provided logger is used by the server, when it is started.
+func startMetricsServer(address string, logger *slog.Logger) {
+	metricsServerMutex.Lock()
+	defer metricsServerMutex.Unlock()
+
+	metricsServerRefs++
+	if metricsServerRefs > 1 {
+		return
+	}
+
+	metricsServer = metrics.New(address, logger)
+	go metricsServer.Start()
+}
+
+// stopMetricsServer stops the shared metrics server, when it was the last
+// instance which is using it.
+func stopMetricsServer() {
+	metricsServerMutex.Lock()
+	defer metricsServerMutex.Unlock()
+
+	metricsServerRefs--
+	if metricsServerRefs > 0 {
+		return
+	}
+
+	metricsServer.Stop()
+}
+
 func contains(field string, fields []string) bool {
 	for _, f := range fields {
 		if f == field {
@@ -82,26 +234,49 @@ func contains(field string, fields []string) bool {
 	return false
 }
 
-func getTimestamp(ts interface{}) time.Time {
-	switch t := ts.(type) {
-	case output.FLBTime:
-		return ts.(output.FLBTime).Time
-	case uint64:
-		return time.Unix(int64(t), 0)
-	// Since Fluent Bit v2.1.0, Event format is represented as 2-element array
-	// with a nested array as the first element. The timestamp field is
-	// allocated in the first position of that nested array:
-	// [[TIMESTAMP, METADATA], MESSAGE]
-	//
-	// See: https://docs.fluentbit.io/manual/concepts/key-concepts#event-format
-	case []interface{}:
-		return getTimestamp(ts.([]interface{})[0])
+// toString returns the string representation of the provided value, which is
+// used for the elements of an array in the fields_array column.
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
 	default:
-		slog.Warn("Failed to parse time, defaulting to now")
-		return time.Now()
+		return fmt.Sprintf("%v", v)
 	}
 }
 
+// parseSize parses a size in bytes. The size can have one of the units "K",
+// "M" or "G" (or "KB", "MB" and "GB"), which are interpreted as powers of 1024.
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	size = strings.TrimSuffix(size, "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(size, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+
+	value, err := strconv.ParseInt(strings.TrimRight(size, "KMG"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return value * multiplier, nil
+}
+
 //export FLBPluginRegister
 func FLBPluginRegister(def unsafe.Pointer) int {
 	return output.FLBPluginRegister(def, "clickhouse", "ClickHouse Output Plugin for Fluent Bit")
@@ -111,6 +286,13 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 func FLBPluginInit(plugin unsafe.Pointer) int {
 	var err error
 
+	p := &instance{
+		lastFlush:  time.Now(),
+		writeMutex: &sync.Mutex{},
+		done:       make(chan struct{}),
+		wg:         &sync.WaitGroup{},
+	}
+
 	// Configure our logging library. The logs can be written in "console"
 	// format or in "json" format. The default is "console", because it is
 	// better to read during development. In a production environment you should
@@ -121,23 +303,33 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	logFormat := output.FLBPluginConfigKey(plugin, "log_format")
 	logLevel := output.FLBPluginConfigKey(plugin, "log_level")
 
-	logger := logger.New(logFormat, logLevel)
-	logger.Info("Version information.", "version", slog.GroupValue(version.Info()...))
-	logger.Info("Build information.", "build", slog.GroupValue(version.BuildContext()...))
+	// The name of the instance is used as label for all metrics and is added
+	// to all log lines of the instance, so that it is possible to distinguish
+	// between multiple outputs which are using the plugin. If the name isn't
+	// provided we use the same naming schema as Fluent Bit.
+	p.name = output.FLBPluginConfigKey(plugin, "instance_name")
+	if p.name == "" {
+		p.name = fmt.Sprintf("clickhouse.%d", instanceCount)
+	}
+	instanceCount++
+
+	p.logger = logger.New(logFormat, logLevel).With(slog.String("instance", p.name))
+	p.logger.Info("Version information.", "version", slog.GroupValue(version.Info()...))
+	p.logger.Info("Build information.", "build", slog.GroupValue(version.BuildContext()...))
 
 	// Read the configuration for the address where the metrics server should
-	// listen on. Then create a new metrics server and start the server in a new
-	// Go routine via the `Start` method.
+	// listen on. Then start the metrics server, which is shared between all
+	// instances of the plugin. This means that only the address of the first
+	// instance is used.
 	//
-	// When the plugin exits the metrics server should be stopped via the `Stop`
-	// method.
+	// When the plugin exits the metrics server should be stopped via the
+	// `stopMetricsServer` function.
 	metricsServerAddress := output.FLBPluginConfigKey(plugin, "metrics_server_address")
 	if metricsServerAddress == "" {
 		metricsServerAddress = defaultMetricsServerAddress
 	}
 
-	metricsServer = metrics.New(metricsServerAddress)
-	go metricsServer.Start()
+	startMetricsServer(metricsServerAddress, p.logger)
 
 	// Read all configuration values required for the ClickHouse client. Once we
 	// have all configuration values we create a new ClickHouse client, which
@@ -145,11 +337,210 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	// the FLBPluginFlushCtx function is called.
 	address := output.FLBPluginConfigKey(plugin, "address")
 
-	database = output.FLBPluginConfigKey(plugin, "database")
+	database := output.FLBPluginConfigKey(plugin, "database")
 	if database == "" {
 		database = defaultDatabase
 	}
 
+	table := output.FLBPluginConfigKey(plugin, "table")
+	if table == "" {
+		table = defaultTable
+	}
+
+	// The routes are used to write records into different tables, based on
+	// the tag of a record or the value of a field. All records which are not
+	// matched by a route are written to the configured table.
+	routes := output.FLBPluginConfigKey(plugin, "routes")
+	p.router, err = router.New(routes, table)
+	if err != nil {
+		p.logger.Error("Failed to parse routes", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	// The flatten options define how the keys of a nested record are joined
+	// and normalized. They are also used to generate the keys of the mapping
+	// presets, so that the presets work with all separators.
+	p.flattenOptions.Separator = output.FLBPluginConfigKey(plugin, "key_separator")
+	switch p.flattenOptions.Separator {
+	case "":
+		p.flattenOptions.Separator = defaultKeySeparator
+	case ".", "_", "/":
+	default:
+		p.logger.Warn("Failed to parse keySeparator setting, use default setting", slog.String("provided", p.flattenOptions.Separator), slog.String("default", defaultKeySeparator))
+		p.flattenOptions.Separator = defaultKeySeparator
+	}
+
+	p.flattenOptions.Normalization = output.FLBPluginConfigKey(plugin, "key_normalization")
+	if err := flatten.ValidateNormalization(p.flattenOptions.Normalization); err != nil {
+		p.logger.Error("Failed to parse key normalization", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	keyCharacters := output.FLBPluginConfigKey(plugin, "key_characters")
+	p.flattenOptions.InvalidCharacters, err = flatten.AllowedCharacters(keyCharacters)
+	if err != nil {
+		p.logger.Error("Failed to parse key characters", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	p.flattenOptions.Replacement = output.FLBPluginConfigKey(plugin, "key_replacement")
+	if p.flattenOptions.Replacement == "" {
+		p.flattenOptions.Replacement = defaultKeyReplacement
+	}
+
+	keyMaxLengthStr := output.FLBPluginConfigKey(plugin, "key_max_length")
+	if keyMaxLengthStr != "" {
+		p.flattenOptions.MaxKeyLength, err = strconv.Atoi(keyMaxLengthStr)
+		if err != nil || p.flattenOptions.MaxKeyLength < 0 {
+			p.logger.Warn("Failed to parse keyMaxLength setting, use default setting", slog.Any("error", err), slog.String("provided", keyMaxLengthStr), slog.Int("default", defaultKeyMaxLength))
+			p.flattenOptions.MaxKeyLength = defaultKeyMaxLength
+		}
+	}
+
+	// The limits protect ClickHouse against records with a large number of
+	// nested fields or very long values.
+	maxDepthStr := output.FLBPluginConfigKey(plugin, "max_depth")
+	if maxDepthStr != "" {
+		p.flattenOptions.MaxDepth, err = strconv.Atoi(maxDepthStr)
+		if err != nil || p.flattenOptions.MaxDepth < 0 {
+			p.logger.Warn("Failed to parse maxDepth setting, use default setting", slog.Any("error", err), slog.String("provided", maxDepthStr), slog.Int("default", defaultMaxDepth))
+			p.flattenOptions.MaxDepth = defaultMaxDepth
+		}
+	}
+
+	maxFieldsStr := output.FLBPluginConfigKey(plugin, "max_fields")
+	if maxFieldsStr != "" {
+		p.flattenOptions.MaxFields, err = strconv.Atoi(maxFieldsStr)
+		if err != nil || p.flattenOptions.MaxFields < 0 {
+			p.logger.Warn("Failed to parse maxFields setting, use default setting", slog.Any("error", err), slog.String("provided", maxFieldsStr), slog.Int("default", defaultMaxFields))
+			p.flattenOptions.MaxFields = defaultMaxFields
+		}
+	}
+
+	maxValueLengthStr := output.FLBPluginConfigKey(plugin, "max_value_length")
+	if maxValueLengthStr != "" {
+		p.flattenOptions.MaxValueLength, err = strconv.Atoi(maxValueLengthStr)
+		if err != nil || p.flattenOptions.MaxValueLength < 0 {
+			p.logger.Warn("Failed to parse maxValueLength setting, use default setting", slog.Any("error", err), slog.String("provided", maxValueLengthStr), slog.Int("default", defaultMaxValueLength))
+			p.flattenOptions.MaxValueLength = defaultMaxValueLength
+		}
+	}
+
+	// The mapping defines which fields of a record are written to the cluster,
+	// namespace, app, pod_name, container_name, host and log columns. The
+	// candidates of the preset can be overwritten for each column.
+	mappingPreset := output.FLBPluginConfigKey(plugin, "mapping_preset")
+	mappingOverrides := make(map[string]string)
+	for _, column := range mapping.Columns {
+		mappingOverrides[column] = output.FLBPluginConfigKey(plugin, "mapping_"+column)
+	}
+
+	p.mapping, err = mapping.New(mappingPreset, mappingOverrides, p.flattenOptions)
+	if err != nil {
+		p.logger.Error("Failed to create mapping", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	// The metadata of records in the Fluent Bit v2 event format is only kept,
+	// when a prefix for the metadata fields is configured.
+	p.metadataPrefix = output.FLBPluginConfigKey(plugin, "metadata_prefix")
+
+	// Dedicated columns can be used to write fields of a record directly to a
+	// column of the table instead of the fields_string and fields_number maps.
+	columns := output.FLBPluginConfigKey(plugin, "columns")
+	p.columns, err = clickhouse.ParseColumns(columns)
+	if err != nil {
+		p.logger.Error("Failed to parse columns", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	p.columnKeys = make(map[string]struct{})
+	for _, column := range p.columns {
+		p.columnKeys[column.Key] = struct{}{}
+	}
+
+	removeColumnFieldsStr := output.FLBPluginConfigKey(plugin, "remove_column_fields")
+	if removeColumnFieldsStr == "true" {
+		p.removeColumnFields = true
+	}
+
+	p.storageLayout = output.FLBPluginConfigKey(plugin, "storage_layout")
+	if p.storageLayout == "" {
+		p.storageLayout = defaultStorageLayout
+	}
+
+	// The include and exclude fields are glob patterns or regular expressions
+	// for the flattened keys of a record, to drop noisy fields before they are
+	// written to ClickHouse.
+	includeFields := output.FLBPluginConfigKey(plugin, "include_fields")
+	excludeFields := output.FLBPluginConfigKey(plugin, "exclude_fields")
+	p.filter, err = filter.New(includeFields, excludeFields)
+	if err != nil {
+		p.logger.Error("Failed to parse fields filter", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+	if !p.filter.Empty() && p.storageLayout == clickhouse.StorageLayoutJSON {
+		p.logger.Warn("Include and exclude fields are ignored for the json storage layout")
+	}
+
+	// The redaction rules are used to remove sensitive data, like email
+	// addresses or credit card numbers, from the rows before they are written
+	// to ClickHouse.
+	redactRules := output.FLBPluginConfigKey(plugin, "redact_rules")
+	redactHashKey := output.FLBPluginConfigKey(plugin, "redact_hash_key")
+	p.redactor, err = redact.New(redactRules, redactHashKey)
+	if err != nil {
+		p.logger.Error("Failed to parse redaction rules", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	// The timestamp of a row can be parsed from a field of the record instead
+	// of using the event time of Fluent Bit.
+	p.timeKey = output.FLBPluginConfigKey(plugin, "time_key")
+	timeFormat := output.FLBPluginConfigKey(plugin, "time_format")
+	timeZone := output.FLBPluginConfigKey(plugin, "time_zone")
+	p.timeParser, err = timestamp.New(timeFormat, timeZone)
+	if err != nil {
+		p.logger.Error("Failed to create time parser", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	p.timeFallback = output.FLBPluginConfigKey(plugin, "time_fallback")
+	if p.timeFallback == "" {
+		p.timeFallback = defaultTimeFallback
+	}
+	if err := timestamp.ValidateFallback(p.timeFallback); err != nil {
+		p.logger.Error("Failed to parse time fallback", slog.Any("error", err))
+		stopMetricsServer()
+		return output.FLB_ERROR
+	}
+
+	p.lookupKeys = append(p.mapping.Keys(), p.router.Fields()...)
+	if p.timeKey != "" {
+		p.lookupKeys = append(p.lookupKeys, p.timeKey)
+	}
+	for _, column := range p.columns {
+		p.lookupKeys = append(p.lookupKeys, column.Key)
+	}
+	p.flattenOptions.KeepKeys = p.lookupKeys
+
+	if output.FLBPluginConfigKey(plugin, "fields_bool") == "true" {
+		p.fields.Bool = true
+	}
+
+	if output.FLBPluginConfigKey(plugin, "fields_array") == "true" {
+		p.fields.Array = true
+		p.flattenOptions.KeepArrays = true
+	}
+
 	username := output.FLBPluginConfigKey(plugin, "username")
 
 	password := output.FLBPluginConfigKey(plugin, "password")
@@ -167,17 +558,22 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 	maxIdleConnsStr := output.FLBPluginConfigKey(plugin, "max_idle_conns")
 	maxIdleConns, err := strconv.Atoi(maxIdleConnsStr)
 	if err != nil || maxIdleConns < 0 {
-		slog.Warn("Failed to parse maxIdleConns setting, use default setting", slog.Any("error", err), slog.String("provided", maxIdleConnsStr), slog.Int("default", defaultMaxIdleConns))
+		p.logger.Warn("Failed to parse maxIdleConns setting, use default setting", slog.Any("error", err), slog.String("provided", maxIdleConnsStr), slog.Int("default", defaultMaxIdleConns))
 		maxIdleConns = defaultMaxIdleConns
 	}
 
 	maxOpenConnsStr := output.FLBPluginConfigKey(plugin, "max_open_conns")
 	maxOpenConns, err := strconv.Atoi(maxOpenConnsStr)
 	if err != nil || maxOpenConns < 0 {
-		slog.Warn("Failed to parse maxOpenConns setting, use default setting", slog.Any("error", err), slog.String("provided", maxOpenConnsStr), slog.Int("default", defaultMaxOpenConns))
+		p.logger.Warn("Failed to parse maxOpenConns setting, use default setting", slog.Any("error", err), slog.String("provided", maxOpenConnsStr), slog.Int("default", defaultMaxOpenConns))
 		maxOpenConns = defaultMaxOpenConns
 	}
 
+	insertMode := output.FLBPluginConfigKey(plugin, "insert_mode")
+	if insertMode == "" {
+		insertMode = defaultInsertMode
+	}
+
 	asyncInsertStr := output.FLBPluginConfigKey(plugin, "async_insert")
 	var asyncInsert bool
 	if asyncInsertStr == "true" {
@@ -190,39 +586,232 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 		waitForAsyncInsert = true
 	}
 
+	// When asynchronous flushing is enabled, full batches are handed off to a
+	// pool of writer goroutines, so that Fluent Bit isn't blocked while a batch
+	// is written to ClickHouse. The number of goroutines is equal to the
+	// maximum number of open connections.
+	asyncFlushStr := output.FLBPluginConfigKey(plugin, "async_flush")
+	var asyncFlush bool
+	if asyncFlushStr == "true" {
+		asyncFlush = true
+	}
+
+	// The protocol is used to connect to ClickHouse. When the HTTP protocol is
+	// used, a proxy and additional headers can be configured. The username and
+	// password are sent via basic authentication in this case.
+	protocol := output.FLBPluginConfigKey(plugin, "protocol")
+	if protocol == "" {
+		protocol = defaultProtocol
+	}
+
+	httpProxyURL := output.FLBPluginConfigKey(plugin, "http_proxy_url")
+	httpHeaders := output.FLBPluginConfigKey(plugin, "http_headers")
+
+	// TLS is used for the connection to ClickHouse, when it is enabled. If a
+	// client certificate and key are configured, they are used for mutual TLS.
+	// The CA and the client certificate are reloaded when the files change.
+	tlsStr := output.FLBPluginConfigKey(plugin, "tls")
+	var tlsEnabled bool
+	if tlsStr == "true" {
+		tlsEnabled = true
+	}
+
+	tlsCAFile := output.FLBPluginConfigKey(plugin, "tls_ca_file")
+	tlsCertFile := output.FLBPluginConfigKey(plugin, "tls_cert_file")
+	tlsKeyFile := output.FLBPluginConfigKey(plugin, "tls_key_file")
+	tlsServerName := output.FLBPluginConfigKey(plugin, "tls_server_name")
+
+	tlsInsecureSkipVerifyStr := output.FLBPluginConfigKey(plugin, "tls_insecure_skip_verify")
+	var tlsInsecureSkipVerify bool
+	if tlsInsecureSkipVerifyStr == "true" {
+		tlsInsecureSkipVerify = true
+	}
+
+	// The compression method is used to compress the data which is sent to
+	// ClickHouse. The level is only used by methods which support different
+	// levels, e.g. zstd.
+	compression := output.FLBPluginConfigKey(plugin, "compression")
+	if compression == "" {
+		compression = defaultCompression
+	}
+
+	compressionLevelStr := output.FLBPluginConfigKey(plugin, "compression_level")
+	compressionLevel, err := strconv.Atoi(compressionLevelStr)
+	if err != nil || compressionLevel < 0 {
+		p.logger.Warn("Failed to parse compressionLevel setting, use default setting", slog.Any("error", err), slog.String("provided", compressionLevelStr), slog.Int("default", defaultCompressionLevel))
+		compressionLevel = defaultCompressionLevel
+	}
+
+	// When the schema should be created, the client creates the database and
+	// the tables on startup, if they do not exist. If a cluster is configured,
+	// a ReplicatedMergeTree table and a Distributed table is created for each
+	// table.
+	createSchemaStr := output.FLBPluginConfigKey(plugin, "create_schema")
+	var createSchema bool
+	if createSchemaStr == "true" {
+		createSchema = true
+	}
+
+	schemaCluster := output.FLBPluginConfigKey(plugin, "schema_cluster")
+	schemaTTL := output.FLBPluginConfigKey(plugin, "schema_ttl")
+	schemaPartitionBy := output.FLBPluginConfigKey(plugin, "schema_partition_by")
+	schemaOrderBy := output.FLBPluginConfigKey(plugin, "schema_order_by")
+
+	// The schema of all tables is verified on startup, so that a missing column
+	// or a column with a wrong type is reported before the first write fails.
+	schemaVerify := output.FLBPluginConfigKey(plugin, "schema_verify")
+	if schemaVerify == "" {
+		schemaVerify = defaultSchemaVerify
+	}
+
 	batchSizeStr := output.FLBPluginConfigKey(plugin, "batch_size")
-	batchSize, err = strconv.ParseInt(batchSizeStr, 10, 64)
-	if err != nil || batchSize < 0 {
-		slog.Warn("Failed to parse batchSize setting, use default setting", slog.Any("error", err), slog.String("provided", batchSizeStr), slog.Int64("default", defaultBatchSize))
-		batchSize = defaultBatchSize
+	p.batchSize, err = strconv.ParseInt(batchSizeStr, 10, 64)
+	if err != nil || p.batchSize < 0 {
+		p.logger.Warn("Failed to parse batchSize setting, use default setting", slog.Any("error", err), slog.String("provided", batchSizeStr), slog.Int64("default", defaultBatchSize))
+		p.batchSize = defaultBatchSize
+	}
+
+	// The write-ahead log is only enabled, when a directory is configured. If
+	// multiple instances of the plugin are used, each instance must use its
+	// own directory.
+	walDirectory := output.FLBPluginConfigKey(plugin, "wal_directory")
+
+	walMaxSizeStr := output.FLBPluginConfigKey(plugin, "wal_max_size")
+	walMaxSize, err := parseSize(walMaxSizeStr)
+	if err != nil || walMaxSize < 0 {
+		p.logger.Warn("Failed to parse walMaxSize setting, use default setting", slog.Any("error", err), slog.String("provided", walMaxSizeStr), slog.Int64("default", defaultWALMaxSize))
+		walMaxSize = defaultWALMaxSize
+	}
+
+	// The retry settings are used by the buffer of the ClickHouse client. When
+	// a write fails the rows are kept in the buffer and the write is retried
+	// with an exponential backoff, until the maximum number of attempts is
+	// reached. A value of 0 for the maximum number of attempts means that the
+	// rows are never dropped.
+	maxAttemptsStr := output.FLBPluginConfigKey(plugin, "max_attempts")
+	maxAttempts, err := strconv.Atoi(maxAttemptsStr)
+	if err != nil || maxAttempts < 0 {
+		p.logger.Warn("Failed to parse maxAttempts setting, use default setting", slog.Any("error", err), slog.String("provided", maxAttemptsStr), slog.Int("default", defaultMaxAttempts))
+		maxAttempts = defaultMaxAttempts
+	}
+
+	retryBackoffStr := output.FLBPluginConfigKey(plugin, "retry_backoff")
+	retryBackoff, err := time.ParseDuration(retryBackoffStr)
+	if err != nil || retryBackoff <= 0 {
+		p.logger.Warn("Failed to parse retryBackoff setting, use default setting", slog.Any("error", err), slog.String("provided", retryBackoffStr), slog.Duration("default", defaultRetryBackoff))
+		retryBackoff = defaultRetryBackoff
+	}
+
+	retryMaxBackoffStr := output.FLBPluginConfigKey(plugin, "retry_max_backoff")
+	retryMaxBackoff, err := time.ParseDuration(retryMaxBackoffStr)
+	if err != nil || retryMaxBackoff < retryBackoff {
+		p.logger.Warn("Failed to parse retryMaxBackoff setting, use default setting", slog.Any("error", err), slog.String("provided", retryMaxBackoffStr), slog.Duration("default", defaultRetryMaxBackoff))
+		retryMaxBackoff = max(defaultRetryMaxBackoff, retryBackoff)
+	}
+
+	// The buffer can be limited by the number of rows and by the estimated
+	// size of the rows in bytes. When one of the limits is reached, the
+	// overflow policy decides if Fluent Bit has to retry the chunk or if the
+	// oldest or newest rows are dropped.
+	maxBufferSizeStr := output.FLBPluginConfigKey(plugin, "max_buffer_size")
+	maxBufferSize, err := strconv.Atoi(maxBufferSizeStr)
+	if err != nil || maxBufferSize < 0 {
+		p.logger.Warn("Failed to parse maxBufferSize setting, use default setting", slog.Any("error", err), slog.String("provided", maxBufferSizeStr), slog.Int("default", defaultMaxBufferSize))
+		maxBufferSize = defaultMaxBufferSize
+	}
+
+	maxBufferBytesStr := output.FLBPluginConfigKey(plugin, "max_buffer_bytes")
+	maxBufferBytes, err := parseSize(maxBufferBytesStr)
+	if err != nil || maxBufferBytes < 0 {
+		p.logger.Warn("Failed to parse maxBufferBytes setting, use default setting", slog.Any("error", err), slog.String("provided", maxBufferBytesStr), slog.Int64("default", defaultMaxBufferBytes))
+		maxBufferBytes = defaultMaxBufferBytes
+	}
+
+	p.overflowPolicy = output.FLBPluginConfigKey(plugin, "buffer_overflow_policy")
+	if p.overflowPolicy == "" {
+		p.overflowPolicy = defaultOverflowPolicy
 	}
 
 	flushIntervalStr := output.FLBPluginConfigKey(plugin, "flush_interval")
-	flushInterval, err = time.ParseDuration(flushIntervalStr)
-	if err != nil || flushInterval < 1*time.Second {
-		slog.Warn("Failed to parse flushInterval setting, use default setting", slog.Any("error", err), slog.String("provided", flushIntervalStr), slog.Duration("default", defaultFlushInterval))
-		flushInterval = defaultFlushInterval
+	p.flushInterval, err = time.ParseDuration(flushIntervalStr)
+	if err != nil || p.flushInterval < 1*time.Second {
+		p.logger.Warn("Failed to parse flushInterval setting, use default setting", slog.Any("error", err), slog.String("provided", flushIntervalStr), slog.Duration("default", defaultFlushInterval))
+		p.flushInterval = defaultFlushInterval
 	}
 
 	forceNumberFieldsStr := output.FLBPluginConfigKey(plugin, "force_number_fields")
-	forceNumberFields = strings.Split(forceNumberFieldsStr, ",")
+	p.forceNumberFields = strings.Split(forceNumberFieldsStr, ",")
 
 	forceUnderscoresStr := output.FLBPluginConfigKey(plugin, "force_underscores")
-	forceUnderscores, err = strconv.ParseBool(forceUnderscoresStr)
+	p.forceUnderscores, err = strconv.ParseBool(forceUnderscoresStr)
 	if err != nil {
-		slog.Warn("Failed to parse forceUnderscores setting, use default setting", slog.Any("error", err), slog.String("provided", forceUnderscoresStr), slog.Bool("default", defaultForceUnderscores))
-		forceUnderscores = defaultForceUnderscores
+		p.logger.Warn("Failed to parse forceUnderscores setting, use default setting", slog.Any("error", err), slog.String("provided", forceUnderscoresStr), slog.Bool("default", defaultForceUnderscores))
+		p.forceUnderscores = defaultForceUnderscores
 	}
 
-	slog.Info("Clickhouse configuration", slog.String("address", address), slog.String("username", username), slog.String("password", "*****"), slog.String("database", database), slog.String("dialTimeout", dialTimeout), slog.String("connMaxLifetime", connMaxLifetime), slog.Int("maxIdleConns", maxIdleConns), slog.Int("maxOpenConns", maxOpenConns), slog.Int64("batchSize", batchSize), slog.Duration("flushInterval", flushInterval))
+	p.logger.Info("Clickhouse configuration", slog.String("address", address), slog.String("username", username), slog.String("password", "*****"), slog.String("database", database), slog.String("table", table), slog.String("dialTimeout", dialTimeout), slog.String("connMaxLifetime", connMaxLifetime), slog.Int("maxIdleConns", maxIdleConns), slog.Int("maxOpenConns", maxOpenConns), slog.String("insertMode", insertMode), slog.Int64("batchSize", p.batchSize), slog.Duration("flushInterval", p.flushInterval), slog.String("walDirectory", walDirectory), slog.Int64("walMaxSize", walMaxSize), slog.Int("maxAttempts", maxAttempts), slog.Duration("retryBackoff", retryBackoff), slog.Duration("retryMaxBackoff", retryMaxBackoff), slog.Int("maxBufferSize", maxBufferSize), slog.Int64("maxBufferBytes", maxBufferBytes), slog.String("overflowPolicy", p.overflowPolicy), slog.Bool("asyncFlush", asyncFlush), slog.Bool("tls", tlsEnabled), slog.String("tlsCAFile", tlsCAFile), slog.String("tlsCertFile", tlsCertFile), slog.String("tlsKeyFile", tlsKeyFile), slog.String("tlsServerName", tlsServerName), slog.Bool("tlsInsecureSkipVerify", tlsInsecureSkipVerify), slog.String("compression", compression), slog.Int("compressionLevel", compressionLevel), slog.String("protocol", protocol), slog.String("httpProxyURL", httpProxyURL), slog.Bool("createSchema", createSchema), slog.String("schemaCluster", schemaCluster), slog.String("schemaTTL", schemaTTL), slog.String("schemaPartitionBy", schemaPartitionBy), slog.String("schemaOrderBy", schemaOrderBy), slog.String("schemaVerify", schemaVerify), slog.String("mappingPreset", mappingPreset), slog.String("metadataPrefix", p.metadataPrefix), slog.String("columns", columns), slog.Bool("removeColumnFields", p.removeColumnFields), slog.String("includeFields", includeFields), slog.String("excludeFields", excludeFields), slog.String("redactRules", redactRules), slog.Bool("fieldsBool", p.fields.Bool), slog.Bool("fieldsArray", p.fields.Array), slog.String("storageLayout", p.storageLayout), slog.String("timeKey", p.timeKey), slog.String("timeFormat", timeFormat), slog.String("timeZone", timeZone), slog.String("timeFallback", p.timeFallback), slog.String("keySeparator", p.flattenOptions.Separator), slog.String("keyNormalization", p.flattenOptions.Normalization), slog.String("keyCharacters", keyCharacters), slog.String("keyReplacement", p.flattenOptions.Replacement), slog.Int("keyMaxLength", p.flattenOptions.MaxKeyLength), slog.Int("maxDepth", p.flattenOptions.MaxDepth), slog.Int("maxFields", p.flattenOptions.MaxFields), slog.Int("maxValueLength", p.flattenOptions.MaxValueLength))
 
-	clickhouseClient, err := clickhouse.NewClient(address, username, password, database, dialTimeout, connMaxLifetime, maxIdleConns, maxOpenConns, asyncInsert, waitForAsyncInsert)
+	clickhouseClient, err := clickhouse.NewClient(clickhouse.Options{
+		Name:               p.name,
+		Address:            address,
+		Username:           username,
+		Password:           password,
+		Database:           database,
+		Table:              table,
+		Tables:             p.router.Tables(),
+		DialTimeout:        dialTimeout,
+		ConnMaxLifetime:    connMaxLifetime,
+		MaxIdleConns:       maxIdleConns,
+		MaxOpenConns:       maxOpenConns,
+		InsertMode:         insertMode,
+		AsyncInsert:        asyncInsert,
+		WaitForAsyncInsert: waitForAsyncInsert,
+		WALDirectory:       walDirectory,
+		WALMaxSize:         walMaxSize,
+		MaxAttempts:        maxAttempts,
+		RetryBackoff:       retryBackoff,
+		RetryMaxBackoff:    retryMaxBackoff,
+		MaxBufferRows:      maxBufferSize,
+		MaxBufferBytes:     maxBufferBytes,
+		OverflowPolicy:     p.overflowPolicy,
+		AsyncFlush:         asyncFlush,
+		TLS: clickhouse.TLSOptions{
+			Enabled:            tlsEnabled,
+			CAFile:             tlsCAFile,
+			CertFile:           tlsCertFile,
+			KeyFile:            tlsKeyFile,
+			ServerName:         tlsServerName,
+			InsecureSkipVerify: tlsInsecureSkipVerify,
+		},
+		Compression:      compression,
+		CompressionLevel: compressionLevel,
+		Protocol:         protocol,
+		HTTPProxyURL:     httpProxyURL,
+		HTTPHeaders:      httpHeaders,
+		Schema: clickhouse.SchemaOptions{
+			Create:      createSchema,
+			Verify:      schemaVerify,
+			Cluster:     schemaCluster,
+			TTL:         schemaTTL,
+			PartitionBy: schemaPartitionBy,
+			OrderBy:     schemaOrderBy,
+		},
+		StorageLayout: p.storageLayout,
+		Fields:        p.fields,
+		Columns:       p.columns,
+		Logger:        p.logger,
+	})
 	if err != nil {
-		slog.Error("Failed to create ClickHouse client", slog.Any("error", err))
+		p.logger.Error("Failed to create ClickHouse client", slog.Any("error", err))
+		stopMetricsServer()
 		return output.FLB_ERROR
 	}
 
-	client = clickhouseClient
+	p.client = clickhouseClient
+	output.FLBPluginSetContext(plugin, p)
+
+	p.wg.Add(1)
+	go p.backgroundFlush()
 
 	return output.FLB_OK
 }
@@ -235,31 +824,176 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	dec := output.NewDecoder(data, int(length))
+	p, ok := output.FLBPluginGetContext(ctx).(*instance)
+	if !ok {
+		slog.Error("Flush called for unknown instance")
+		return output.FLB_ERROR
+	}
+
+	return p.flush(data, int(length), C.GoString(tag))
+}
+
+// flush decodes the records of a chunk, adds them to the buffer of the
+// ClickHouse client and writes the buffer to ClickHouse when the configured
+// batch size or flush interval is reached. The tag of the chunk is used to
+// select the table for the records.
+//
+// Once the records of a chunk were added to the buffer, the buffer owns them
+// and is responsible for retrying failed writes, so that we always return
+// FLB_OK in this case. Fluent Bit only has to retry a chunk, when it could not
+// be added to the buffer: This is the case when the buffer is full, when a
+// previous write failed and the buffer already contains a full batch or when
+// the rows could not be added to the write-ahead log. If one of the drop
+// overflow policies is used, we never push back on Fluent Bit because the
+// buffer is full.
+func (p *instance) flush(data unsafe.Pointer, length int, tag string) int {
+	if p.overflowPolicy == clickhouse.OverflowPolicyRetry && p.client.Backoff() && p.client.BufferLen() >= int(p.batchSize) {
+		p.logger.Debug("Buffer is full and waiting for the next write attempt, retry chunk")
+		return output.FLB_RETRY
+	}
+
+	dec := decoder.New(C.GoBytes(data, C.int(length)))
+	rows := make(map[string][]clickhouse.Row)
+
+	// redactions contains the number of redacted values for each redaction
+	// rule, which are reported once all records of the chunk were processed.
+	redactions := make([]int, len(p.redactor.Rules()))
+	defer func() {
+		for i, rule := range p.redactor.Rules() {
+			if redactions[i] > 0 {
+				redactionsTotalMetric.WithLabelValues(p.name, rule.String()).Add(float64(redactions[i]))
+			}
+		}
+	}()
 
 	for {
-		ret, ts, record := output.GetRecord(dec)
-		if ret != 0 {
+		record, err := dec.Next()
+		if err != nil {
+			if err != io.EOF {
+				errorsTotalMetric.WithLabelValues(p.name).Inc()
+				p.logger.Error("Failed to decode record", slog.Any("error", err))
+			}
 			break
 		}
 
-		inputRecordsTotalMetric.Inc()
+		inputRecordsTotalMetric.WithLabelValues(p.name).Inc()
 
-		timestamp := getTimestamp(ts)
+		// The metadata of a record is only kept, when a prefix is configured.
+		// It is added as nested field to the record, so that it is flattened
+		// like all other fields. Binary values in the metadata, e.g. the
+		// trace_id and span_id of OpenTelemetry logs, are hex encoded.
+		if p.metadataPrefix != "" && record.Metadata != nil {
+			if _, ok := record.Fields[p.metadataPrefix]; !ok {
+				decoder.EncodeBinary(record.Metadata)
+				record.Fields[p.metadataPrefix] = record.Metadata
+			}
+		}
 
-		data, err := flatten.Flatten(record)
-		if err != nil {
-			slog.Error("Failed to flatten data", slog.Any("error", err))
-			break
+		// When the json storage layout is used, the record isn't flattened.
+		// Instead we only look up the fields which are required for the
+		// mapping, the routing and the dedicated columns.
+		var data map[string]interface{}
+		if p.storageLayout == clickhouse.StorageLayoutJSON {
+			data = make(map[string]interface{}, len(p.lookupKeys))
+			for _, key := range p.lookupKeys {
+				if value, ok := flatten.Lookup(record.Fields, key, p.flattenOptions); ok {
+					data[key] = value
+				}
+			}
+		} else {
+			var clipped flatten.Clipped
+			data, clipped, err = flatten.Flatten(record.Fields, p.flattenOptions)
+			if err != nil {
+				p.logger.Error("Failed to flatten data", slog.Any("error", err))
+				break
+			}
+
+			if clipped.Depth {
+				clippedRecordsTotalMetric.WithLabelValues(p.name, "depth").Inc()
+			}
+			if clipped.Fields {
+				clippedRecordsTotalMetric.WithLabelValues(p.name, "fields").Inc()
+			}
+			if clipped.ValueLength {
+				clippedRecordsTotalMetric.WithLabelValues(p.name, "value_length").Inc()
+			}
+		}
+
+		ts, ok := p.timestamp(record.Timestamp, data)
+		if !ok {
+			p.logger.Debug("Drop record without valid time", slog.String("timeKey", p.timeKey))
+			continue
 		}
 
 		row := clickhouse.Row{
-			Timestamp:    timestamp,
-			FieldsString: make(map[string]string),
-			FieldsNumber: make(map[string]float64),
+			Timestamp: ts,
+			Cluster:   p.mapping.Value(mapping.Cluster, data),
+			Namespace: p.mapping.Value(mapping.Namespace, data),
+			App:       p.mapping.Value(mapping.App, data),
+			Pod:       p.mapping.Value(mapping.Pod, data),
+			Container: p.mapping.Value(mapping.Container, data),
+			Host:      p.mapping.Value(mapping.Host, data),
+			Log:       p.mapping.Value(mapping.Log, data),
 		}
 
+		if len(p.columns) > 0 {
+			row.Columns = make([]any, len(p.columns))
+			for i, column := range p.columns {
+				row.Columns[i] = column.Value(data[column.Key])
+			}
+		}
+
+		if p.storageLayout == clickhouse.StorageLayoutJSON {
+			p.redactNested(&row, record.Fields, redactions)
+
+			row.Fields, err = flatten.JSON(record.Fields)
+			if err != nil {
+				errorsTotalMetric.WithLabelValues(p.name).Inc()
+				p.logger.Error("Failed to encode fields", slog.Any("error", err))
+				continue
+			}
+
+			table := p.router.Route(tag, data)
+			rows[table] = append(rows[table], row)
+			continue
+		}
+
+		row.FieldsString = make(map[string]string)
+		row.FieldsNumber = make(map[string]float64)
+
+		if p.fields.Bool {
+			row.FieldsBool = make(map[string]bool)
+		}
+
+		if p.fields.Array {
+			row.FieldsArray = make(map[string][]string)
+		}
+
+		var droppedKeys int
+
+		mappedKeys := p.mapping.Used(data)
+
 		for k, v := range data {
+			if _, ok := mappedKeys[k]; ok {
+				continue
+			}
+
+			if p.removeColumnFields {
+				if _, ok := p.columnKeys[k]; ok {
+					continue
+				}
+			}
+
+			if !p.filter.Keep(k) {
+				droppedKeys++
+				continue
+			}
+
+			formattedKey := k
+			if p.forceUnderscores {
+				formattedKey = strings.ReplaceAll(k, ".", "_")
+			}
+
 			var stringValue string
 			var numberValue float64
 			var isNumber bool
@@ -268,6 +1002,21 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 			switch t := v.(type) {
 			case nil:
 				isNil = true
+			case bool:
+				if p.fields.Bool {
+					row.FieldsBool[formattedKey] = t
+					continue
+				}
+				stringValue = fmt.Sprintf("%v", v)
+			case []interface{}:
+				// Arrays are only kept intact by the flatten function, when
+				// the fields_array column is enabled.
+				arrayValue := make([]string, 0, len(t))
+				for _, e := range t {
+					arrayValue = append(arrayValue, toString(e))
+				}
+				row.FieldsArray[formattedKey] = arrayValue
+				continue
 			case string:
 				stringValue = t
 			case []byte:
@@ -310,70 +1059,216 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 			}
 
 			if !isNil {
-				switch k {
-				case "cluster":
-					row.Cluster = stringValue
-				case "kubernetes_namespace_name":
-					row.Namespace = stringValue
-				case "kubernetes_labels_k8s-app":
-					row.App = stringValue
-				case "kubernetes_labels_app":
-					row.App = stringValue
-				case "kubernetes_pod_name":
-					row.Pod = stringValue
-				case "kubernetes_container_name":
-					row.Container = stringValue
-				case "kubernetes_host":
-					row.Host = stringValue
-				case "log":
-					row.Log = stringValue
-				default:
-					formattedKey := k
-					if forceUnderscores {
-						formattedKey = strings.ReplaceAll(k, ".", "_")
-					}
-
-					if isNumber {
-						row.FieldsNumber[formattedKey] = numberValue
-					} else {
-						if contains(k, forceNumberFields) {
-							parsedNumber, err := strconv.ParseFloat(stringValue, 64)
-							if err == nil {
-								row.FieldsNumber[formattedKey] = parsedNumber
-							} else {
-								row.FieldsString[formattedKey] = stringValue
-							}
+				if isNumber {
+					row.FieldsNumber[formattedKey] = numberValue
+				} else {
+					if contains(k, p.forceNumberFields) {
+						parsedNumber, err := strconv.ParseFloat(stringValue, 64)
+						if err == nil {
+							row.FieldsNumber[formattedKey] = parsedNumber
 						} else {
 							row.FieldsString[formattedKey] = stringValue
 						}
+					} else {
+						row.FieldsString[formattedKey] = stringValue
 					}
 				}
 			}
 		}
 
-		client.BufferAdd(row)
+		if droppedKeys > 0 {
+			droppedKeysTotalMetric.WithLabelValues(p.name).Add(float64(droppedKeys))
+		}
+
+		p.redact(&row, redactions)
+
+		table := p.router.Route(tag, data)
+		rows[table] = append(rows[table], row)
 	}
 
+	if err := p.client.BufferAdd(rows); err != nil {
+		errorsTotalMetric.WithLabelValues(p.name).Inc()
+		p.logger.Error("Failed to add rows to buffer", slog.Any("error", err))
+		return output.FLB_RETRY
+	}
+
+	p.write(false)
+
+	return output.FLB_OK
+}
+
+// timestamp returns the timestamp for a row. If a time key is configured, the
+// value of the field is parsed and used as timestamp. If the field is missing
+// or can not be parsed, the fallback policy is applied. If false is returned,
+// the record should be dropped.
+//
+// Without a time key or when the fallback is the event time, the event time of
+// Fluent Bit is used. If the event time is not valid, the current time is used.
+func (p *instance) timestamp(eventTime time.Time, data map[string]interface{}) (time.Time, bool) {
+	if p.timeKey != "" {
+		if value, ok := data[p.timeKey]; ok && value != nil {
+			t, err := p.timeParser.Parse(value)
+			if err == nil {
+				return t, true
+			}
+
+			timeParseFailuresTotalMetric.WithLabelValues(p.name).Inc()
+			p.logger.Debug("Failed to parse time", slog.Any("error", err))
+		}
+
+		switch p.timeFallback {
+		case timestamp.FallbackNow:
+			return time.Now(), true
+		case timestamp.FallbackDrop:
+			return time.Time{}, false
+		}
+	}
+
+	if eventTime.IsZero() {
+		p.logger.Warn("Failed to parse time, defaulting to now")
+		return time.Now(), true
+	}
+
+	return eventTime, true
+}
+
+// redactNested applies the redaction rules to the nested fields of a record for
+// the json storage layout. The log line and the values of the String columns
+// are looked up again in the redacted fields instead of redacting them a second
+// time, because they are also contained in the fields, so that each redacted
+// value is only counted once.
+func (p *instance) redactNested(row *clickhouse.Row, fields map[interface{}]interface{}, counts []int) {
+	if p.redactor.Empty() {
+		return
+	}
+
+	p.redactor.RedactNested(fields, p.flattenOptions, counts)
+
+	data := make(map[string]interface{}, len(p.lookupKeys))
+	for _, key := range p.lookupKeys {
+		if value, ok := flatten.Lookup(fields, key, p.flattenOptions); ok {
+			data[key] = value
+		}
+	}
+
+	row.Log = p.mapping.Value(mapping.Log, data)
+
+	for i, column := range p.columns {
+		if _, ok := row.Columns[i].(string); ok {
+			row.Columns[i] = column.Value(data[column.Key])
+		}
+	}
+}
+
+// redact applies the redaction rules to the log line, the values of the String
+// columns and the values of the fields maps of a row. The rules are matched
+// against the keys of the maps, the keys of the dedicated columns and the "log"
+// key for the log line. Redacted numbers are moved to the fields_string map.
+func (p *instance) redact(row *clickhouse.Row, counts []int) {
+	if p.redactor.Empty() {
+		return
+	}
+
+	row.Log, _ = p.redactor.Redact(mapping.Log, row.Log, counts)
+
+	for i, column := range p.columns {
+		if value, ok := row.Columns[i].(string); ok {
+			row.Columns[i], _ = p.redactor.Redact(column.Key, value, counts)
+		}
+	}
+
+	for k, v := range row.FieldsString {
+		if value, ok := p.redactor.Redact(k, v, counts); ok {
+			row.FieldsString[k] = value
+		} else {
+			delete(row.FieldsString, k)
+		}
+	}
+
+	for k, v := range row.FieldsNumber {
+		number := strconv.FormatFloat(v, 'f', -1, 64)
+		value, ok := p.redactor.Redact(k, number, counts)
+		if !ok {
+			delete(row.FieldsNumber, k)
+		} else if value != number {
+			delete(row.FieldsNumber, k)
+			row.FieldsString[k] = value
+		}
+	}
+
+	for k, values := range row.FieldsArray {
+		redacted := values[:0]
+		for _, v := range values {
+			if value, ok := p.redactor.Redact(k, v, counts); ok {
+				redacted = append(redacted, value)
+			}
+		}
+		row.FieldsArray[k] = redacted
+	}
+}
+
+// backgroundFlush writes the buffer to ClickHouse when the flush interval is
+// reached, even when Fluent Bit doesn't call the flush callback, because there
+// are no new records. The function runs until the done channel of the instance
+// is closed.
+func (p *instance) backgroundFlush() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.write(false)
+		}
+	}
+}
+
+// write writes the buffer of the ClickHouse client to ClickHouse, when the
+// configured batch size or flush interval is reached and the client isn't
+// waiting for the next attempt of a failed write. If force is true, the buffer
+// is always written.
+func (p *instance) write(force bool) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
 	startFlushTime := time.Now()
-	currentBatchSize := client.BufferLen()
-	if currentBatchSize < int(batchSize) && lastFlush.Add(flushInterval).After(startFlushTime) {
-		return output.FLB_OK
+	currentBatchSize := p.client.BufferLen()
+	if currentBatchSize == 0 {
+		return nil
 	}
 
-	slog.Info("Start flushing", slog.Int("batchSize", currentBatchSize), slog.Duration("flushInterval", startFlushTime.Sub(lastFlush)))
-	err := client.BufferWrite()
+	if !force {
+		if p.client.Backoff() {
+			return nil
+		}
+
+		if currentBatchSize < int(p.batchSize) && p.lastFlush.Add(p.flushInterval).After(startFlushTime) {
+			return nil
+		}
+	}
+
+	p.logger.Info("Start flushing", slog.Int("batchSize", currentBatchSize), slog.Duration("flushInterval", startFlushTime.Sub(p.lastFlush)))
+	err := p.client.BufferWrite()
+	if errors.Is(err, clickhouse.ErrWorkersBusy) {
+		p.logger.Debug("All writers are busy, keep rows in buffer", slog.Int("batchSize", currentBatchSize))
+		return nil
+	}
 	if err != nil {
-		errorsTotalMetric.Inc()
-		slog.Error("Error while writing buffer", slog.Any("error", err))
-		return output.FLB_ERROR
+		errorsTotalMetric.WithLabelValues(p.name).Inc()
+		p.logger.Error("Error while writing buffer", slog.Any("error", err))
+		return err
 	}
 
-	lastFlush = time.Now()
-	batchSizeMetric.Observe(float64(currentBatchSize))
-	flushTimeSecondsMetric.Observe(lastFlush.Sub(startFlushTime).Seconds())
-	slog.Info("End flushing", slog.Duration("flushTime", lastFlush.Sub(startFlushTime)))
+	p.lastFlush = time.Now()
+	batchSizeMetric.WithLabelValues(p.name).Observe(float64(currentBatchSize))
+	flushTimeSecondsMetric.WithLabelValues(p.name).Observe(p.lastFlush.Sub(startFlushTime).Seconds())
+	p.logger.Info("End flushing", slog.Duration("flushTime", p.lastFlush.Sub(startFlushTime)))
 
-	return output.FLB_OK
+	return nil
 }
 
 //export FLBPluginExit
@@ -384,14 +1279,34 @@ func FLBPluginExit() int {
 
 //export FLBPluginExitCtx
 func FLBPluginExitCtx(ctx unsafe.Pointer) int {
-	slog.Info("Shutdown Fluent Bit plugin")
-	defer metricsServer.Stop()
+	p, ok := output.FLBPluginGetContext(ctx).(*instance)
+	if !ok {
+		slog.Error("Exit called for unknown instance")
+		return output.FLB_ERROR
+	}
+
+	return p.exit()
+}
+
+// exit stops the background flusher, writes all remaining records from the
+// buffer to ClickHouse and closes the ClickHouse client.
+func (p *instance) exit() int {
+	p.logger.Info("Shutdown Fluent Bit plugin")
+	defer stopMetricsServer()
+
+	close(p.done)
+	p.wg.Wait()
+
+	err := p.write(true)
+
+	if err := p.client.Close(); err != nil {
+		p.logger.Warn("Failed to close ClickHouse client", slog.Any("error", err))
+	}
 
-	err := client.BufferWrite()
 	if err != nil {
-		slog.Error("Error while writing buffer", slog.Any("error", err))
 		return output.FLB_ERROR
 	}
+
 	return output.FLB_OK
 }
 
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kobsio/klogs/pkg/clickhouse"
+	"github.com/kobsio/klogs/pkg/flatten"
+	"github.com/kobsio/klogs/pkg/mapping"
+	"github.com/kobsio/klogs/pkg/redact"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactNested(t *testing.T) {
+	redactor, err := redact.New("email => mask", "")
+	require.NoError(t, err)
+
+	m, err := mapping.New(mapping.PresetKubernetes, nil, flatten.Options{})
+	require.NoError(t, err)
+
+	columns, err := clickhouse.ParseColumns("content_user => user String, content_status => status Float64")
+	require.NoError(t, err)
+
+	p := &instance{redactor: redactor, mapping: m, columns: columns}
+	p.lookupKeys = append(p.mapping.Keys(), "content_user", "content_status")
+
+	fields := map[interface{}]interface{}{
+		"log": "login of jane.doe@example.com",
+		"content": map[interface{}]interface{}{
+			"user":   "jane.doe@example.com",
+			"status": int64(200),
+		},
+	}
+	row := clickhouse.Row{Log: "login of jane.doe@example.com", Columns: []any{"jane.doe@example.com", float64(200)}}
+
+	counts := make([]int, len(redactor.Rules()))
+	p.redactNested(&row, fields, counts)
+
+	require.Equal(t, []int{2}, counts)
+	require.Equal(t, "login of [REDACTED]", row.Log)
+	require.Equal(t, []any{"[REDACTED]", float64(200)}, row.Columns)
+	require.Equal(t, "login of [REDACTED]", fields["log"])
+}
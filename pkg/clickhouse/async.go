@@ -0,0 +1,198 @@
+package clickhouse
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// batch is a list of rows for a single table, which is written by one of the
+// writer goroutines, when asynchronous flushing is enabled. The segment is the
+// last segment of the write-ahead log, which contains rows of the batch.
+type batch struct {
+	table   string
+	rows    []Row
+	segment uint64
+	done    bool
+}
+
+// startWorkers starts the provided number of writer goroutines. The number of
+// goroutines should be equal to the maximum number of open connections, so
+// that each goroutine can use its own connection.
+func (c *Client) startWorkers(workers int) {
+	c.batches = make(chan *batch)
+	c.inflight = make(map[string][]*batch)
+	c.closing = make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		c.workers.Add(1)
+		go c.worker()
+	}
+}
+
+// stopWorkers hands off all remaining rows to the writer goroutines and waits
+// until all batches are written. Failed batches are not retried after the
+// workers are stopped, so that the plugin can exit in time.
+func (c *Client) stopWorkers() {
+	close(c.closing)
+
+	c.bufferMutex.Lock()
+	if err := c.dispatch(true); err != nil {
+		c.logger.Error("Failed to dispatch remaining rows", slog.Any("error", err))
+	}
+	c.bufferMutex.Unlock()
+
+	close(c.batches)
+	c.workers.Wait()
+}
+
+// dispatch hands off the buffers of all tables to the writer goroutines and
+// clears the buffers, so that new rows can be added while the batches are
+// written. If all writer goroutines are busy and block is false, the rows are
+// kept in the buffer and are handed off with the next call. The caller must
+// hold the buffer mutex.
+//
+// While the writer goroutines are busy, e.g. because they are retrying failed
+// batches, the client backs off, so that the plugin pushes back on Fluent Bit
+// instead of growing the buffer. If no rows could be handed off at all,
+// ErrWorkersBusy is returned.
+func (c *Client) dispatch(block bool) error {
+	var busy bool
+	var dispatched int
+
+	for _, table := range c.tables {
+		if len(c.buffers[table]) == 0 {
+			continue
+		}
+
+		b := &batch{table: table, rows: c.buffers[table]}
+
+		// Start a new segment in the write-ahead log, so that all segments up
+		// to the returned segment can be removed, once the batch and all
+		// batches which were dispatched before were written.
+		if w, ok := c.wals[table]; ok {
+			id, err := w.Rotate()
+			if err != nil {
+				return err
+			}
+			b.segment = id
+		}
+
+		c.inflight[table] = append(c.inflight[table], b)
+
+		if block {
+			// The buffer mutex must be released while we wait for a free
+			// writer goroutine, because the writer goroutines need the mutex
+			// to mark their batches as done.
+			c.bufferMutex.Unlock()
+			c.batches <- b
+			c.bufferMutex.Lock()
+		} else {
+			select {
+			case c.batches <- b:
+			default:
+				c.inflight[table] = c.inflight[table][:len(c.inflight[table])-1]
+				busy = true
+				continue
+			}
+		}
+
+		dispatched = dispatched + len(b.rows)
+
+		for _, row := range b.rows {
+			c.bufferRows--
+			c.bufferBytes = c.bufferBytes - row.size()
+		}
+
+		c.buffers[table] = c.buffers[table][len(b.rows):]
+		if len(c.buffers[table]) == 0 {
+			delete(c.buffers, table)
+		}
+	}
+
+	c.updateBufferMetrics()
+
+	if !busy {
+		c.nextAttempt = time.Time{}
+		return nil
+	}
+
+	c.nextAttempt = time.Now().Add(c.retryBackoff)
+	if dispatched == 0 {
+		return ErrWorkersBusy
+	}
+
+	return nil
+}
+
+// worker writes all batches it receives until the batches channel is closed.
+func (c *Client) worker() {
+	defer c.workers.Done()
+
+	for b := range c.batches {
+		c.writeBatch(b)
+	}
+}
+
+// writeBatch writes a single batch to ClickHouse. When the write fails, it is
+// retried with an exponential backoff until the maximum number of attempts is
+// reached. Then the rows of the batch are dropped.
+func (c *Client) writeBatch(b *batch) {
+	for attempts := 1; ; attempts++ {
+		startTime := time.Now()
+		err := c.writer.write(context.Background(), c.database, b.table, b.rows)
+		if err == nil {
+			c.logger.Debug("Batch written", slog.String("table", b.table), slog.Int("rows", len(b.rows)), slog.Duration("flushTime", time.Since(startTime)))
+			uncompressedBytesTotalMetric.WithLabelValues(c.name).Add(float64(rowsSize(b.rows)))
+			c.done(b)
+			return
+		}
+
+		if c.maxAttempts > 0 && attempts >= c.maxAttempts {
+			c.logger.Error("Failed to write batch, dropping rows", slog.String("table", b.table), slog.Int("rows", len(b.rows)), slog.Int("attempt", attempts), slog.Any("error", err))
+			droppedRowsTotalMetric.WithLabelValues(c.name, "max_attempts").Add(float64(len(b.rows)))
+			c.done(b)
+			return
+		}
+
+		c.logger.Error("Failed to write batch", slog.String("table", b.table), slog.Int("rows", len(b.rows)), slog.Int("attempt", attempts), slog.Any("error", err))
+
+		select {
+		case <-c.closing:
+			// When the client is closed, we give up on the batch. If the
+			// write-ahead log is enabled, the rows are kept in the log and
+			// are written when the log is replayed.
+			c.logger.Error("Client is closed, giving up on batch", slog.String("table", b.table), slog.Int("rows", len(b.rows)))
+			return
+		case <-time.After(c.backoffDuration(attempts)):
+		}
+	}
+}
+
+// done marks the provided batch as done. Because the batches can be written in
+// a different order than they were dispatched, the write-ahead log is only
+// truncated up to the last batch for which all previous batches are also done.
+func (c *Client) done(b *batch) {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
+
+	b.done = true
+
+	inflight := c.inflight[b.table]
+	var segment uint64
+	var truncate bool
+
+	for len(inflight) > 0 && inflight[0].done {
+		segment = inflight[0].segment
+		truncate = true
+		inflight = inflight[1:]
+	}
+
+	c.inflight[b.table] = inflight
+
+	if w, ok := c.wals[b.table]; ok && truncate {
+		if err := w.Truncate(segment); err != nil {
+			c.logger.Warn("Failed to truncate write-ahead log", slog.String("table", b.table), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncFlush(t *testing.T) {
+	row1 := Row{Log: "log1"}
+	row2 := Row{Log: "log2"}
+	row3 := Row{Log: "log3"}
+
+	t.Run("should write all rows", func(t *testing.T) {
+		w := &fakeWriter{}
+		client := newFakeClient(t, w, Options{AsyncFlush: true, MaxOpenConns: 2}, "logs", "audit_logs")
+
+		// The writer goroutines may not wait for batches yet, so that the
+		// rows are handed off, once a writer goroutine is ready.
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}, "audit_logs": {row2}}))
+		require.Eventually(t, func() bool {
+			return !errors.Is(client.BufferWrite(), ErrWorkersBusy)
+		}, time.Second, time.Millisecond)
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row3}}))
+		require.NoError(t, client.Close())
+		require.Equal(t, 0, client.BufferLen())
+		require.ElementsMatch(t, []Row{row1, row3}, w.written["logs"])
+		require.Equal(t, []Row{row2}, w.written["audit_logs"])
+	})
+
+	t.Run("should retry failed batches", func(t *testing.T) {
+		w := &fakeWriter{errs: []error{fmt.Errorf("connection refused")}}
+		client := newFakeClient(t, w, Options{AsyncFlush: true, MaxOpenConns: 1, MaxAttempts: 3, RetryBackoff: time.Millisecond, RetryMaxBackoff: time.Millisecond}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.Eventually(t, func() bool {
+			if err := client.BufferWrite(); err != nil {
+				require.ErrorIs(t, err, ErrWorkersBusy)
+			}
+			return client.BufferLen() == 0
+		}, time.Second, time.Millisecond)
+		require.Eventually(t, func() bool {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			return len(w.written["logs"]) == 1
+		}, time.Second, time.Millisecond)
+		require.NoError(t, client.Close())
+		require.Equal(t, map[string][]Row{"logs": {row1}}, w.written)
+	})
+
+	t.Run("should keep rows in buffer and back off when workers are busy", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{RetryBackoff: time.Hour}, "logs")
+		client.asyncFlush = true
+		client.batches = make(chan *batch)
+		client.inflight = make(map[string][]*batch)
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.ErrorIs(t, client.BufferWrite(), ErrWorkersBusy)
+		require.Equal(t, 1, client.BufferLen())
+		require.Empty(t, client.inflight["logs"])
+		require.True(t, client.Backoff())
+	})
+
+	t.Run("should stop backing off when rows are handed off", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{RetryBackoff: time.Hour}, "logs")
+		client.asyncFlush = true
+		client.batches = make(chan *batch, 1)
+		client.inflight = make(map[string][]*batch)
+		client.nextAttempt = time.Now().Add(time.Hour)
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.NoError(t, client.BufferWrite())
+		require.Equal(t, 0, client.BufferLen())
+		require.False(t, client.Backoff())
+	})
+}
+
+func TestAsyncFlushTruncate(t *testing.T) {
+	client := newFakeClient(t, &fakeWriter{}, Options{WALDirectory: t.TempDir()}, "logs")
+	client.inflight = make(map[string][]*batch)
+
+	require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {{Log: "log1"}}}))
+	segment1, err := client.wals["logs"].Rotate()
+	require.NoError(t, err)
+	require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {{Log: "log2"}}}))
+	segment2, err := client.wals["logs"].Rotate()
+	require.NoError(t, err)
+
+	batch1 := &batch{table: "logs", segment: segment1}
+	batch2 := &batch{table: "logs", segment: segment2}
+	client.inflight["logs"] = []*batch{batch1, batch2}
+
+	client.done(batch2)
+	require.Len(t, client.inflight["logs"], 2)
+	require.Equal(t, int64(2*(8+len(`{"Timestamp":"0001-01-01T00:00:00Z","Cluster":"","Namespace":"","App":"","Pod":"","Container":"","Host":"","FieldsString":null,"FieldsNumber":null,"Log":"log1"}`))), client.wals["logs"].Size())
+
+	client.done(batch1)
+	require.Empty(t, client.inflight["logs"])
+	require.Equal(t, int64(0), client.wals["logs"].Size())
+}
@@ -2,17 +2,127 @@ package clickhouse
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/kobsio/klogs/pkg/wal"
+
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// walSegmentSize is the size of a single segment of the write-ahead log in
+// bytes.
+const walSegmentSize int64 = 16 * 1024 * 1024
+
+// identifierRegexp is used to validate the names of databases and tables,
+// before they are used in a SQL statement.
+var identifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+const (
+	// OverflowPolicyRetry rejects new rows when the buffer is full, so that
+	// Fluent Bit has to retry them later. This is the default overflow policy.
+	OverflowPolicyRetry = "retry"
+	// OverflowPolicyDropOldest drops the oldest rows from the buffer, until the
+	// new rows fit into the buffer.
+	OverflowPolicyDropOldest = "drop_oldest"
+	// OverflowPolicyDropNewest drops all new rows which do not fit into the
+	// buffer.
+	OverflowPolicyDropNewest = "drop_newest"
+)
+
+// ErrBufferFull is returned by BufferAdd, when the rows do not fit into the
+// buffer and the overflow policy is OverflowPolicyRetry.
+var ErrBufferFull = errors.New("buffer is full")
+
+// ErrWorkersBusy is returned by BufferWrite, when asynchronous flushing is
+// enabled and no rows could be handed off, because all writer goroutines are
+// busy.
+var ErrWorkersBusy = errors.New("all writers are busy")
+
+var (
+	droppedRowsTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "dropped_rows_total",
+		Help:      "Number of rows which were dropped and never written to ClickHouse.",
+	}, []string{"instance", "reason"})
+	bufferRowsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "klogs",
+		Name:      "buffer_rows",
+		Help:      "Number of rows in the buffer.",
+	}, []string{"instance"})
+	bufferBytesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "klogs",
+		Name:      "buffer_bytes",
+		Help:      "Estimated size of the rows in the buffer in bytes.",
+	}, []string{"instance"})
+	uncompressedBytesTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "uncompressed_bytes_total",
+		Help:      "Estimated size of the rows written to ClickHouse in bytes, before they are compressed.",
+	}, []string{"instance"})
+	sentBytesTotalMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klogs",
+		Name:      "sent_bytes_total",
+		Help:      "Number of bytes sent to ClickHouse, after the data was compressed.",
+	}, []string{"instance"})
 )
 
-// Row is the structure of a single row in ClickHouse.
+// Options contains all options, which can be used to configure the ClickHouse
+// client.
+type Options struct {
+	Name               string
+	Address            string
+	Username           string
+	Password           string
+	Database           string
+	Table              string
+	Tables             []string
+	DialTimeout        string
+	ConnMaxLifetime    string
+	MaxIdleConns       int
+	MaxOpenConns       int
+	InsertMode         string
+	AsyncInsert        bool
+	WaitForAsyncInsert bool
+	WALDirectory       string
+	WALMaxSize         int64
+	MaxAttempts        int
+	RetryBackoff       time.Duration
+	RetryMaxBackoff    time.Duration
+	MaxBufferRows      int
+	MaxBufferBytes     int64
+	OverflowPolicy     string
+	AsyncFlush         bool
+	TLS                TLSOptions
+	Compression        string
+	CompressionLevel   int
+	Protocol           string
+	HTTPProxyURL       string
+	HTTPHeaders        string
+	Schema             SchemaOptions
+	StorageLayout      string
+	Fields             FieldsOptions
+	Columns            []Column
+	// Logger is used for all logs of the client. If it is nil, the default
+	// logger is used.
+	Logger *slog.Logger
+}
+
+// Row is the structure of a single row in ClickHouse. When the json storage
+// layout is used, the Fields contain the JSON encoded record instead of the
+// FieldsString and FieldsNumber maps.
 type Row struct {
 	Timestamp    time.Time
 	Cluster      string
@@ -24,136 +134,864 @@ type Row struct {
 	FieldsString map[string]string
 	FieldsNumber map[string]float64
 	Log          string
+	Fields       string              `json:",omitempty"`
+	FieldsBool   map[string]bool     `json:",omitempty"`
+	FieldsArray  map[string][]string `json:",omitempty"`
+	Columns      []any               `json:",omitempty"`
+}
+
+// size returns the estimated size of the row in bytes. The size is used to
+// limit the memory which is used by the buffer.
+func (r Row) size() int64 {
+	size := 8 + len(r.Cluster) + len(r.Namespace) + len(r.App) + len(r.Pod) + len(r.Container) + len(r.Host) + len(r.Log) + len(r.Fields)
+
+	for k, v := range r.FieldsString {
+		size = size + len(k) + len(v)
+	}
+
+	for k := range r.FieldsNumber {
+		size = size + len(k) + 8
+	}
+
+	for k := range r.FieldsBool {
+		size = size + len(k) + 1
+	}
+
+	for k, v := range r.FieldsArray {
+		size = size + len(k)
+		for _, s := range v {
+			size = size + len(s)
+		}
+	}
+
+	for _, v := range r.Columns {
+		if s, ok := v.(string); ok {
+			size = size + len(s)
+		} else {
+			size = size + 8
+		}
+	}
+
+	return int64(size)
+}
+
+// rowsSize returns the estimated size of the provided rows in bytes.
+func rowsSize(rows []Row) int64 {
+	var size int64
+	for _, row := range rows {
+		size = size + row.size()
+	}
+
+	return size
+}
+
+// walFloat is a number of a row in the write-ahead log. JSON can not represent
+// NaN and infinite numbers, so that they are encoded as strings, e.g. "NaN" or
+// "+Inf". All other numbers are encoded as JSON numbers.
+type walFloat float64
+
+func (f walFloat) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return json.Marshal(strconv.FormatFloat(float64(f), 'g', -1, 64))
+	}
+
+	return json.Marshal(float64(f))
+}
+
+func (f *walFloat) UnmarshalJSON(data []byte) error {
+	var value float64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		parsedValue, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		value = parsedValue
+	} else if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*f = walFloat(value)
+	return nil
+}
+
+// walRow is the record of a row in the write-ahead log. The numbers in the
+// fields_number map and the dedicated columns are encoded as walFloat, so that
+// rows with NaN and infinite numbers can also be written to the log.
+type walRow struct {
+	Row
+	FieldsNumber map[string]walFloat
+	Columns      []any `json:",omitempty"`
+}
+
+func newWALRow(row Row) walRow {
+	r := walRow{Row: row}
+
+	if row.FieldsNumber != nil {
+		r.FieldsNumber = make(map[string]walFloat, len(row.FieldsNumber))
+		for key, value := range row.FieldsNumber {
+			r.FieldsNumber[key] = walFloat(value)
+		}
+	}
+
+	for _, value := range row.Columns {
+		if v, ok := value.(float64); ok {
+			value = walFloat(v)
+		}
+		r.Columns = append(r.Columns, value)
+	}
+
+	return r
+}
+
+// row returns the row of the record. The values of the dedicated columns are
+// decoded as float64, string or bool and must be converted to the type of the
+// column by the caller.
+func (r walRow) row() Row {
+	row := r.Row
+	row.Columns = r.Columns
+
+	row.FieldsNumber = nil
+	if r.FieldsNumber != nil {
+		row.FieldsNumber = make(map[string]float64, len(r.FieldsNumber))
+		for key, value := range r.FieldsNumber {
+			row.FieldsNumber[key] = float64(value)
+		}
+	}
+
+	return row
 }
 
 // Client can be used to write data to a ClickHouse instance. The client can be
 // created via the NewClient function.
+//
+// The client has a separate buffer for each table, so that records can be
+// routed to different tables in the same database. If a directory for the
+// write-ahead log is configured, each buffer is also persisted on disk in a
+// sub directory with the name of the table.
+//
+// The buffer owns the retries of failed writes: Once a row was added to the
+// buffer it is kept until it was written to ClickHouse or until the write
+// failed for the configured maximum number of attempts. Between the attempts
+// the client backs off exponentially, see the Backoff method.
 type Client struct {
-	client             *sql.DB
-	database           string
-	asyncInsert        bool
-	waitForAsyncInsert bool
-	bufferMutex        *sync.RWMutex
-	buffer             []Row
+	name            string
+	writer          writer
+	database        string
+	table           string
+	tables          []string
+	bufferMutex     *sync.RWMutex
+	buffers         map[string][]Row
+	wals            map[string]*wal.WAL
+	maxAttempts     int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	attempts        map[string]int
+	nextAttempt     time.Time
+	maxBufferRows   int
+	maxBufferBytes  int64
+	overflowPolicy  string
+	bufferRows      int
+	bufferBytes     int64
+	asyncFlush      bool
+	columns         []Column
+	logger          *slog.Logger
+	batches         chan *batch
+	inflight        map[string][]*batch
+	closing         chan struct{}
+	workers         *sync.WaitGroup
 }
 
-// BufferAdd adds a new row to the Clickhouse buffer. This doesn't write the
-// added row. To write the rows in the buffer the `write` method must be called.
-func (c *Client) BufferAdd(row Row) {
+// BufferAdd adds new rows to the Clickhouse buffers. The rows are grouped by
+// the table they should be written to. If the table is empty, the default table
+// of the client is used. This doesn't write the added rows. To write the rows
+// in the buffer the `BufferWrite` method must be called.
+//
+// If the rows do not fit into the buffer, the configured overflow policy is
+// applied: The rows are rejected with ErrBufferFull, the oldest rows in the
+// buffer are dropped or the new rows are dropped.
+//
+// If the write-ahead log is enabled, the rows are appended to the log of the
+// table before they are added to the buffer. The space in the log is part of
+// the limits of the buffer: With the retry policy wal.ErrFull is returned, when
+// the log of one of the tables is full, so that the rows are either added for
+// all tables or for none of the tables. With the drop policies all new rows
+// which do not fit into the log are dropped, because the space of the oldest
+// rows in the log is only freed, when they were written. The buffer is only
+// changed, when all checks passed.
+func (c *Client) BufferAdd(rows map[string][]Row) error {
 	c.bufferMutex.Lock()
 	defer c.bufferMutex.Unlock()
 
-	c.buffer = append(c.buffer, row)
+	if table, ok := rows[""]; ok {
+		rows[c.table] = append(rows[c.table], table...)
+		delete(rows, "")
+	}
+
+	records := c.encode(rows)
+
+	addRows, addBytes := countRows(rows)
+
+	switch c.overflowPolicy {
+	case OverflowPolicyDropOldest:
+		// The new rows must fit into an empty buffer, because we can not drop
+		// more than all rows of the buffer.
+		rows, records = c.dropNewest(rows, records, 0, 0)
+		rows, records = c.dropNewestWAL(rows, records)
+	case OverflowPolicyDropNewest:
+		rows, records = c.dropNewest(rows, records, c.bufferRows, c.bufferBytes)
+		rows, records = c.dropNewestWAL(rows, records)
+	default:
+		if !c.fits(addRows, addBytes) {
+			return ErrBufferFull
+		}
+
+		for table, tableRecords := range records {
+			if w, ok := c.wals[table]; ok && !w.Fits(tableRecords...) {
+				return wal.ErrFull
+			}
+		}
+	}
+
+	// If the records can not be appended to the log of one of the tables, the
+	// records which were already appended to the logs of the other tables are
+	// removed again, because the rows are not added to the buffer and Fluent
+	// Bit retries the whole chunk. Otherwise the rows would also be replayed
+	// when the plugin is restarted and written twice.
+	positions := make(map[string]wal.Position, len(records))
+	for table, tableRecords := range records {
+		if w, ok := c.wals[table]; ok && len(tableRecords) > 0 {
+			positions[table] = w.Position()
+
+			err := w.Append(tableRecords...)
+			if err == nil {
+				err = w.Sync()
+			}
+			if err != nil {
+				c.reset(positions)
+				return err
+			}
+		}
+	}
+
+	if c.overflowPolicy == OverflowPolicyDropOldest {
+		addRows, addBytes = countRows(rows)
+		c.dropOldest(addRows, addBytes)
+	}
+
+	for table, tableRows := range rows {
+		c.append(table, tableRows...)
+	}
+
+	return nil
+}
+
+// reset removes all records, which were appended to the logs of the tables
+// after the provided positions.
+func (c *Client) reset(positions map[string]wal.Position) {
+	for table, position := range positions {
+		if err := c.wals[table].Reset(position); err != nil {
+			c.logger.Warn("Failed to reset write-ahead log", slog.String("table", table), slog.Any("error", err))
+		}
+	}
+}
+
+// encode returns the records for the write-ahead logs of the provided rows.
+// Rows which can not be encoded are removed from the provided rows, so that a
+// single invalid row doesn't block all other rows of the chunk. If the write-ahead log is disabled, nil is returned.
+func (c *Client) encode(rows map[string][]Row) map[string][][]byte {
+	if len(c.wals) == 0 {
+		return nil
+	}
+
+	records := make(map[string][][]byte, len(rows))
+
+	for table, tableRows := range rows {
+		encodedRows := tableRows[:0]
+		for _, row := range tableRows {
+			record, err := json.Marshal(newWALRow(row))
+			if err != nil {
+				droppedRowsTotalMetric.WithLabelValues(c.name, "invalid").Inc()
+				c.logger.Warn("Failed to encode row for write-ahead log, drop row", slog.String("table", table), slog.Any("error", err))
+				continue
+			}
+			records[table] = append(records[table], record)
+			encodedRows = append(encodedRows, row)
+		}
+		rows[table] = encodedRows
+	}
+
+	return records
+}
+
+// countRows returns the number of rows and the estimated size in bytes of the
+// provided rows.
+func countRows(rows map[string][]Row) (int, int64) {
+	var count int
+	var size int64
+	for _, tableRows := range rows {
+		count = count + len(tableRows)
+		size = size + rowsSize(tableRows)
+	}
+
+	return count, size
+}
+
+// fits returns true, when the provided number of rows and bytes can be added
+// to the buffer without exceeding the configured limits.
+func (c *Client) fits(rows int, bytes int64) bool {
+	return fitsLimits(c.bufferRows+rows, c.bufferBytes+bytes, c.maxBufferRows, c.maxBufferBytes)
+}
+
+func fitsLimits(rows int, bytes int64, maxRows int, maxBytes int64) bool {
+	if maxRows > 0 && rows > maxRows {
+		return false
+	}
+
+	if maxBytes > 0 && bytes > maxBytes {
+		return false
+	}
+
+	return true
+}
+
+// append adds the provided rows to the buffer of the table, without checking
+// the limits of the buffer.
+func (c *Client) append(table string, rows ...Row) {
+	for _, row := range rows {
+		c.bufferRows++
+		c.bufferBytes = c.bufferBytes + row.size()
+	}
+
+	c.buffers[table] = append(c.buffers[table], rows...)
+	c.updateBufferMetrics()
+}
+
+// dropOldest drops the oldest rows from the buffer, until the provided number
+// of rows and bytes fit into the buffer. The oldest row is the row with the
+// oldest timestamp at the beginning of the buffers of all tables.
+//
+// The dropped rows are not removed from the write-ahead log. They are removed
+// from the log, when the next batch of the table was written, but they are
+// replayed when the plugin is restarted before.
+func (c *Client) dropOldest(rows int, bytes int64) {
+	var dropped int
+
+	for !c.fits(rows, bytes) && c.bufferRows > 0 {
+		var oldest string
+		for _, table := range c.tables {
+			if len(c.buffers[table]) == 0 {
+				continue
+			}
+
+			if oldest == "" || c.buffers[table][0].Timestamp.Before(c.buffers[oldest][0].Timestamp) {
+				oldest = table
+			}
+		}
+
+		c.bufferRows--
+		c.bufferBytes = c.bufferBytes - c.buffers[oldest][0].size()
+		c.buffers[oldest] = c.buffers[oldest][1:]
+		dropped++
+	}
+
+	droppedRowsTotalMetric.WithLabelValues(c.name, "overflow").Add(float64(dropped))
+	c.updateBufferMetrics()
+}
+
+// dropNewest returns the provided rows and records without all rows which do
+// not fit into a buffer, which already contains the provided number of rows
+// and bytes. The tables are processed in the configured order.
+func (c *Client) dropNewest(rows map[string][]Row, records map[string][][]byte, bufferRows int, bufferBytes int64) (map[string][]Row, map[string][][]byte) {
+	var dropped int
+
+	filteredRows := make(map[string][]Row, len(rows))
+	filteredRecords := make(map[string][][]byte, len(records))
+
+	for _, table := range c.tables {
+		for i, row := range rows[table] {
+			if !fitsLimits(bufferRows+1, bufferBytes+row.size(), c.maxBufferRows, c.maxBufferBytes) {
+				dropped++
+				continue
+			}
+
+			bufferRows++
+			bufferBytes = bufferBytes + row.size()
+			filteredRows[table] = append(filteredRows[table], row)
+			if records != nil {
+				filteredRecords[table] = append(filteredRecords[table], records[table][i])
+			}
+		}
+	}
+
+	droppedRowsTotalMetric.WithLabelValues(c.name, "overflow").Add(float64(dropped))
+	return filteredRows, filteredRecords
+}
+
+// dropNewestWAL returns the provided rows and records without all rows which
+// do not fit into the write-ahead log of their table anymore.
+func (c *Client) dropNewestWAL(rows map[string][]Row, records map[string][][]byte) (map[string][]Row, map[string][][]byte) {
+	var dropped int
+
+	for table, tableRecords := range records {
+		w, ok := c.wals[table]
+		if !ok || w.Fits(tableRecords...) {
+			continue
+		}
+
+		n := sort.Search(len(tableRecords), func(i int) bool {
+			return !w.Fits(tableRecords[:i+1]...)
+		})
+
+		dropped = dropped + len(tableRecords) - n
+		rows[table] = rows[table][:n]
+		records[table] = tableRecords[:n]
+	}
+
+	droppedRowsTotalMetric.WithLabelValues(c.name, "overflow").Add(float64(dropped))
+	return rows, records
+}
+
+// updateBufferMetrics sets the metrics for the number of rows and the size of
+// the buffer to the current values.
+func (c *Client) updateBufferMetrics() {
+	bufferRowsMetric.WithLabelValues(c.name).Set(float64(c.bufferRows))
+	bufferBytesMetric.WithLabelValues(c.name).Set(float64(c.bufferBytes))
 }
 
-// BufferLen returns the number of items in the buffer.
+// BufferLen returns the number of items in the buffers of all tables.
 func (c *Client) BufferLen() int {
 	c.bufferMutex.Lock()
 	defer c.bufferMutex.Unlock()
 
-	return len(c.buffer)
+	return c.bufferRows
 }
 
-// BufferWrite writes a list of rows from the buffer to the configured
-// ClickHouse instance.
-func (c *Client) BufferWrite() error {
-	ctx := context.Background()
+// Backoff returns true, when the last write failed and the client is waiting
+// for the next attempt. If asynchronous flushing is enabled, it returns true,
+// when the last rows could not be handed off, because all writer goroutines
+// were busy. While the client backs off, BufferWrite should not be called,
+// except the plugin is stopped.
+func (c *Client) Backoff() bool {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
 
+	return time.Now().Before(c.nextAttempt)
+}
+
+// BufferWrite writes the rows from the buffers of all tables to the configured
+// ClickHouse instance. The buffer of a table is only cleared when all rows were
+// written successfully, so that a failed table can be retried without writing
+// the rows of the other tables twice.
+//
+// When the rows of a table can not be written, they are kept in the buffer and
+// the number of attempts for the table is increased. If the maximum number of
+// attempts is reached, the rows are dropped. The returned error contains the
+// errors for all failed tables.
+//
+// If asynchronous flushing is enabled, the rows are handed off to the writer
+// goroutines instead, see the dispatch method. When no rows could be handed
+// off, ErrWorkersBusy is returned.
+func (c *Client) BufferWrite() error {
 	c.bufferMutex.Lock()
 	defer c.bufferMutex.Unlock()
 
-	var settings string
+	if c.asyncFlush {
+		return c.dispatch(false)
+	}
 
-	if c.asyncInsert {
-		if c.waitForAsyncInsert {
-			settings = "SETTINGS async_insert = 1, wait_for_async_insert = 1"
-		} else {
-			settings = "SETTINGS async_insert = 1, wait_for_async_insert = 0"
+	var errs []error
+
+	for _, table := range c.tables {
+		if len(c.buffers[table]) == 0 {
+			continue
+		}
+
+		// Before the rows are written we start a new segment in the
+		// write-ahead log, so that we can remove all segments containing the
+		// written rows, once they were committed to ClickHouse.
+		var segment uint64
+		if w, ok := c.wals[table]; ok {
+			id, err := w.Rotate()
+			if err != nil {
+				return err
+			}
+			segment = id
 		}
+
+		if err := c.writer.write(context.Background(), c.database, table, c.buffers[table]); err != nil {
+			c.attempts[table]++
+
+			if c.maxAttempts > 0 && c.attempts[table] >= c.maxAttempts {
+				droppedRowsTotalMetric.WithLabelValues(c.name, "max_attempts").Add(float64(len(c.buffers[table])))
+				errs = append(errs, fmt.Errorf("dropped %d rows for table %s after %d attempts: %w", len(c.buffers[table]), table, c.attempts[table], err))
+				c.clear(table, segment)
+				continue
+			}
+
+			errs = append(errs, fmt.Errorf("failed to write %d rows to table %s (attempt %d): %w", len(c.buffers[table]), table, c.attempts[table], err))
+			continue
+		}
+
+		uncompressedBytesTotalMetric.WithLabelValues(c.name).Add(float64(rowsSize(c.buffers[table])))
+		c.clear(table, segment)
 	}
 
-	// #nosec G201
-	sql := fmt.Sprintf("INSERT INTO %s.logs (timestamp, cluster, namespace, app, pod_name, container_name, host, fields_string, fields_number, log) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) %s", c.database, settings)
+	c.nextAttempt = time.Now().Add(c.backoff())
 
-	tx, err := c.client.BeginTx(ctx, nil)
-	if err != nil {
-		slog.Error("Begin transaction failure", slog.Any("error", err))
-		return err
+	return errors.Join(errs...)
+}
+
+// clear removes all rows for the provided table from the buffer and from the
+// write-ahead log, up to the provided segment.
+func (c *Client) clear(table string, segment uint64) {
+	for _, row := range c.buffers[table] {
+		c.bufferRows--
+		c.bufferBytes = c.bufferBytes - row.size()
 	}
 
-	defer tx.Rollback()
+	delete(c.buffers, table)
+	delete(c.attempts, table)
+	c.updateBufferMetrics()
 
-	stmt, err := tx.PrepareContext(ctx, sql)
-	if err != nil {
-		slog.Error("Prepare statement failure", slog.Any("error", err))
-		return err
+	if w, ok := c.wals[table]; ok {
+		if err := w.Truncate(segment); err != nil {
+			c.logger.Warn("Failed to truncate write-ahead log", slog.String("table", table), slog.Any("error", err))
+		}
+	}
+}
+
+// backoff returns the duration, which should be waited before the next write
+// attempt. The duration is doubled for each failed attempt of a table, but it
+// is never larger than the configured maximum backoff.
+func (c *Client) backoff() time.Duration {
+	var attempts int
+	for _, a := range c.attempts {
+		attempts = max(attempts, a)
+	}
+
+	return c.backoffDuration(attempts)
+}
+
+// backoffDuration returns the duration, which should be waited after the
+// provided number of failed attempts.
+func (c *Client) backoffDuration(attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
 	}
 
-	for _, l := range c.buffer {
-		_, err = stmt.ExecContext(ctx, l.Timestamp, l.Cluster, l.Namespace, l.App, l.Pod, l.Container, l.Host, l.FieldsString, l.FieldsNumber, l.Log)
+	backoff := c.retryBackoff
+	for i := 1; i < attempts && backoff < c.retryMaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+
+	return min(backoff, c.retryMaxBackoff)
+}
+
+// replay adds all rows from the write-ahead logs of all tables to the buffers
+// of the tables and returns the number of replayed rows.
+func (c *Client) replay() (int, error) {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
+
+	var count int
 
+	for table, w := range c.wals {
+		err := w.Replay(func(record []byte) error {
+			var r walRow
+			if err := json.Unmarshal(record, &r); err != nil {
+				return err
+			}
+			row := r.row()
+
+			// The values of the dedicated columns are decoded as float64,
+			// string or bool, so that we have to convert them back to the type
+			// of the column. If the columns were changed since the row was
+			// added to the log, missing values are set to the zero value.
+			var values []any
+			for i, column := range c.columns {
+				var value any
+				if i < len(row.Columns) {
+					value = row.Columns[i]
+				}
+				values = append(values, column.Value(value))
+			}
+			row.Columns = values
+
+			c.append(table, row)
+			count++
+			return nil
+		})
 		if err != nil {
-			slog.Error("Statement exec failure", slog.Any("error", err))
-			return err
+			return count, err
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		slog.Error("Commit failure", slog.Any("error", err))
-		return err
+	return count, nil
+}
+
+// Close can be used to close the underlying connection to ClickHouse and the
+// write-ahead logs. If asynchronous flushing is enabled, the remaining rows in
+// the buffer are handed off to the writer goroutines and Close waits until all
+// writer goroutines are finished.
+func (c *Client) Close() error {
+	if c.asyncFlush {
+		c.stopWorkers()
+	}
+
+	for table, w := range c.wals {
+		if err := w.Close(); err != nil {
+			c.logger.Warn("Failed to close write-ahead log", slog.String("table", table), slog.Any("error", err))
+		}
+	}
+
+	return c.writer.close()
+}
+
+// validateIdentifier returns an error when the provided name can not be used
+// as database or table name. We only allow letters, digits and underscores, so
+// that the names can not be used to inject SQL into our statements.
+func validateIdentifier(kind, name string) error {
+	if !identifierRegexp.MatchString(name) {
+		return fmt.Errorf("invalid %s name %q: must only contain letters, digits and underscores and must not start with a digit", kind, name)
 	}
 
-	c.buffer = make([]Row, 0)
 	return nil
 }
 
-// Close can be used to close the underlying sql client for ClickHouse.
-func (c *Client) Close() error {
-	return c.client.Close()
+// quoteIdentifier quotes the provided database or table name, so that it can
+// be used in a SQL statement. The name must be validated via the
+// validateIdentifier function before.
+func quoteIdentifier(name string) string {
+	return "`" + name + "`"
+}
+
+// newClient returns a new client for the provided writer and tables. If a
+// directory for the write-ahead log is configured, the log for each table is
+// opened, but the rows in the log are not replayed.
+func newClient(w writer, tables []string, options Options) (*Client, error) {
+	switch options.OverflowPolicy {
+	case "", OverflowPolicyRetry, OverflowPolicyDropOldest, OverflowPolicyDropNewest:
+	default:
+		return nil, fmt.Errorf("invalid overflow policy %q: must be %q, %q or %q", options.OverflowPolicy, OverflowPolicyRetry, OverflowPolicyDropOldest, OverflowPolicyDropNewest)
+	}
+
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	client := &Client{
+		name:            options.Name,
+		writer:          w,
+		database:        options.Database,
+		table:           options.Table,
+		tables:          tables,
+		bufferMutex:     &sync.RWMutex{},
+		buffers:         make(map[string][]Row),
+		wals:            make(map[string]*wal.WAL),
+		maxAttempts:     options.MaxAttempts,
+		retryBackoff:    options.RetryBackoff,
+		retryMaxBackoff: options.RetryMaxBackoff,
+		attempts:        make(map[string]int),
+		maxBufferRows:   options.MaxBufferRows,
+		maxBufferBytes:  options.MaxBufferBytes,
+		overflowPolicy:  options.OverflowPolicy,
+		asyncFlush:      options.AsyncFlush,
+		columns:         options.Columns,
+		logger:          options.Logger,
+		workers:         &sync.WaitGroup{},
+	}
+
+	if options.AsyncFlush {
+		client.startWorkers(max(options.MaxOpenConns, 1))
+	}
+
+	if options.WALDirectory != "" {
+		for _, table := range tables {
+			tableWAL, err := wal.Open(filepath.Join(options.WALDirectory, table), options.WALMaxSize, walSegmentSize)
+			if err != nil {
+				for _, openedWAL := range client.wals {
+					openedWAL.Close()
+				}
+				return nil, err
+			}
+
+			client.wals[table] = tableWAL
+		}
+	}
+
+	return client, nil
 }
 
 // NewClient returns a new client for ClickHouse. The client can then be used to
-// write data to ClickHouse via the "Write" method.
-func NewClient(address, username, password, database, dialTimeout, connMaxLifetime string, maxIdleConns, maxOpenConns int, asyncInsert, waitForAsyncInsert bool) (*Client, error) {
-	parsedDialTimeout, err := time.ParseDuration(dialTimeout)
+// write data to ClickHouse via the "BufferWrite" method.
+func NewClient(options Options) (*Client, error) {
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	if err := validateIdentifier("database", options.Database); err != nil {
+		return nil, err
+	}
+
+	// The default table is always the first table in the list of tables, so
+	// that it is written first when the buffers are written.
+	tables := []string{options.Table}
+	for _, table := range options.Tables {
+		if table != options.Table {
+			tables = append(tables, table)
+		}
+	}
+
+	for _, table := range tables {
+		if err := validateIdentifier("table", table); err != nil {
+			return nil, err
+		}
+	}
+
+	parsedDialTimeout, err := time.ParseDuration(options.DialTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	parsedConnMaxLifetime, err := time.ParseDuration(connMaxLifetime)
+	parsedConnMaxLifetime, err := time.ParseDuration(options.ConnMaxLifetime)
 	if err != nil {
 		return nil, err
 	}
 
-	conn := clickhouse.OpenDB(&clickhouse.Options{
-		Addr: strings.Split(address, ","),
+	tlsConfig, err := newTLSConfig(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateStorageLayout(options.StorageLayout, options.Fields); err != nil {
+		return nil, err
+	}
+
+	protocol, err := newProtocol(options.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := newCompression(protocol, options.Compression, options.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	clickhouseOptions := &clickhouse.Options{
+		Protocol: protocol,
+		Addr:     strings.Split(options.Address, ","),
 		Auth: clickhouse.Auth{
-			Database: database,
-			Username: username,
-			Password: password,
+			Database: options.Database,
+			Username: options.Username,
+			Password: options.Password,
 		},
-		DialTimeout: parsedDialTimeout,
-	})
-	conn.SetMaxIdleConns(maxIdleConns)
-	conn.SetMaxOpenConns(maxOpenConns)
-	conn.SetConnMaxLifetime(parsedConnMaxLifetime)
+		DialContext:     newDialContext(options.Name, parsedDialTimeout, tlsConfig),
+		Compression:     compression,
+		DialTimeout:     parsedDialTimeout,
+		MaxIdleConns:    options.MaxIdleConns,
+		MaxOpenConns:    options.MaxOpenConns,
+		ConnMaxLifetime: parsedConnMaxLifetime,
+	}
+
+	// When the HTTP protocol is used, the TLS handshake is done by our dial
+	// function, which is set as TLS dial function of the HTTP transport of
+	// clickhouse-go. The TLS configuration must also be set, so that
+	// clickhouse-go uses "https" as scheme and the transport can establish TLS
+	// connections via a proxy. The username and password are sent via basic
+	// authentication, so that they can also be checked by a load balancer in
+	// front of ClickHouse.
+	if protocol == clickhouse.HTTP {
+		httpProxyURL, err := newHTTPProxyURL(options.HTTPProxyURL)
+		if err != nil {
+			return nil, err
+		}
 
-	if err := conn.PingContext(context.Background()); err != nil {
+		if err := validateHTTPProxyTLS(clickhouseOptions.Addr, httpProxyURL, options.TLS); err != nil {
+			return nil, err
+		}
+
+		httpHeaders, err := newHTTPHeaders(options.HTTPHeaders, options.Username, options.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		clickhouseOptions.TLS = tlsConfig
+		clickhouseOptions.DialContext = newDialContext(options.Name, parsedDialTimeout, nil)
+		clickhouseOptions.HTTPProxyURL = httpProxyURL
+		if tlsConfig != nil {
+			clickhouseOptions.TransportFunc = newHTTPTransportFunc(newDialContext(options.Name, parsedDialTimeout, tlsConfig))
+		}
+		clickhouseOptions.HttpHeaders = httpHeaders
+		clickhouseOptions.Auth.Username = ""
+		clickhouseOptions.Auth.Password = ""
+	}
+
+	// ClickHouse rejects connections for a database which doesn't exist. When
+	// the schema should be created, we do not set the database for the
+	// connection, so that we can create it. This is possible because all
+	// statements contain the name of the database.
+	if options.Schema.Create {
+		clickhouseOptions.Auth.Database = ""
+	}
+
+	w, err := newWriter(options.InsertMode, clickhouseOptions, options.AsyncInsert, options.WaitForAsyncInsert, options.StorageLayout, options.Fields, options.Columns, options.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.ping(context.Background()); err != nil {
 		if exception, ok := err.(*clickhouse.Exception); ok {
-			slog.Error(fmt.Sprintf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace))
+			options.Logger.Error(fmt.Sprintf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace))
 		} else {
-			slog.Error("Failed to ping database", slog.Any("error", err))
+			options.Logger.Error("Failed to ping database", slog.Any("error", err))
 		}
 
+		w.close()
 		return nil, err
 	}
 
-	return &Client{
-		client:             conn,
-		database:           database,
-		asyncInsert:        asyncInsert,
-		waitForAsyncInsert: waitForAsyncInsert,
-		bufferMutex:        &sync.RWMutex{},
-		buffer:             make([]Row, 0),
-	}, nil
+	if options.Schema.Create {
+		if err := createSchema(context.Background(), w, options.Database, tables, tableColumns(options.StorageLayout, options.Fields, options.Columns), options.Schema, options.Logger); err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+
+	if err := verifySchema(context.Background(), w, options.Database, tables, tableColumns(options.StorageLayout, options.Fields, options.Columns), options.Schema.Verify, options.Logger); err != nil {
+		w.close()
+		return nil, err
+	}
+
+	client, err := newClient(w, tables, options)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+
+	// If a directory for the write-ahead log is configured, we replay all rows
+	// which were not written to ClickHouse before the plugin was stopped. If
+	// the replayed rows can not be written now, they are kept in the buffer and
+	// in the log, so that they are written with the next batch.
+	if options.WALDirectory != "" {
+		replayed, err := client.replay()
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		if replayed > 0 {
+			client.logger.Info("Replay rows from write-ahead log", slog.Int("rows", replayed))
+
+			if err := client.BufferWrite(); err != nil {
+				client.logger.Warn("Failed to write replayed rows, rows will be written with the next batch", slog.Any("error", err))
+			}
+		}
+	}
+
+	return client, nil
 }
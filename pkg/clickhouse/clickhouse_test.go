@@ -0,0 +1,384 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kobsio/klogs/pkg/wal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	for _, name := range []string{"logs", "audit_logs", "_logs", "Logs2"} {
+		t.Run("should succeed for "+name, func(t *testing.T) {
+			require.NoError(t, validateIdentifier("table", name))
+		})
+	}
+
+	for _, name := range []string{"", "2logs", "logs.logs", "logs; DROP TABLE logs", "logs`", "ingress-logs"} {
+		t.Run("should fail for "+name, func(t *testing.T) {
+			require.Error(t, validateIdentifier("table", name))
+		})
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	require.Equal(t, "`audit_logs`", quoteIdentifier("audit_logs"))
+}
+
+// fakeWriter implements the writer interface and records all written rows. The
+// errors in the errs slice are returned for the subsequent calls of the write
+// method. All executed statements are recorded and the errors in the execErrs
+// slice are returned for the subsequent calls of the exec method. Queries are
+// answered by the queryFn function.
+type fakeWriter struct {
+	mutex    sync.Mutex
+	errs     []error
+	written  map[string][]Row
+	execErrs []error
+	executed []string
+	queryFn  func(query string, args ...any) ([][]any, error)
+}
+
+func (w *fakeWriter) write(ctx context.Context, database, table string, rows []Row) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.written == nil {
+		w.written = make(map[string][]Row)
+	}
+	w.written[table] = append(w.written[table], rows...)
+	return nil
+}
+
+func (w *fakeWriter) exec(ctx context.Context, query string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.executed = append(w.executed, query)
+
+	if len(w.execErrs) > 0 {
+		err := w.execErrs[0]
+		w.execErrs = w.execErrs[1:]
+		return err
+	}
+
+	return nil
+}
+
+func (w *fakeWriter) query(ctx context.Context, query string, args ...any) (rows, error) {
+	if w.queryFn == nil {
+		return &fakeRows{index: -1}, nil
+	}
+
+	values, err := w.queryFn(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeRows{values: values, index: -1}, nil
+}
+
+func (w *fakeWriter) ping(ctx context.Context) error {
+	return nil
+}
+
+func (w *fakeWriter) close() error {
+	return nil
+}
+
+// fakeRows implements the rows interface for the values returned by the
+// queryFn function of the fakeWriter.
+type fakeRows struct {
+	values [][]any
+	index  int
+}
+
+func (r *fakeRows) Next() bool {
+	r.index++
+	return r.index < len(r.values)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	for i := range dest {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(r.values[r.index][i]))
+	}
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func newFakeClient(t *testing.T, w *fakeWriter, options Options, tables ...string) *Client {
+	options.Database = "logs"
+	options.Table = tables[0]
+
+	client, err := newClient(w, tables, options)
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestBufferWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	row1 := Row{Timestamp: time.Unix(1, 0).UTC(), Namespace: "default", FieldsString: map[string]string{"level": "info"}, FieldsNumber: map[string]float64{"status": 200}, Log: "log1"}
+	row2 := Row{Timestamp: time.Unix(2, 0).UTC(), Namespace: "audit", FieldsString: map[string]string{}, FieldsNumber: map[string]float64{}, Log: "log2"}
+
+	w := &fakeWriter{errs: []error{fmt.Errorf("connection refused"), fmt.Errorf("connection refused")}}
+	client := newFakeClient(t, w, Options{WALDirectory: dir}, "logs", "audit_logs")
+	require.NoError(t, client.BufferAdd(map[string][]Row{"": {row1}, "audit_logs": {row2}}))
+	require.Error(t, client.BufferWrite())
+	require.NoError(t, client.Close())
+
+	client = newFakeClient(t, w, Options{WALDirectory: dir}, "logs", "audit_logs")
+	replayed, err := client.replay()
+	require.NoError(t, err)
+	require.Equal(t, 2, replayed)
+	require.Equal(t, 2, client.BufferLen())
+	require.NoError(t, client.BufferWrite())
+	require.Equal(t, map[string][]Row{"logs": {row1}, "audit_logs": {row2}}, w.written)
+	require.NoError(t, client.Close())
+
+	client = newFakeClient(t, w, Options{WALDirectory: dir}, "logs", "audit_logs")
+	replayed, err = client.replay()
+	require.NoError(t, err)
+	require.Equal(t, 0, replayed)
+	require.NoError(t, client.Close())
+}
+
+func TestBufferWALNonFiniteNumbers(t *testing.T) {
+	dir := t.TempDir()
+	columns := []Column{{Key: "content_duration", Name: "duration", Type: ColumnTypeFloat64}, {Key: "content_level", Name: "level", Type: ColumnTypeString}}
+	row1 := Row{Timestamp: time.Unix(1, 0).UTC(), FieldsString: map[string]string{}, FieldsNumber: map[string]float64{"status": 200}, Log: "log1", Columns: []any{1.5, "info"}}
+	row2 := Row{Timestamp: time.Unix(2, 0).UTC(), FieldsString: map[string]string{}, FieldsNumber: map[string]float64{"latency": math.NaN(), "size": math.Inf(-1)}, Log: "log2", Columns: []any{math.Inf(1), "NaN"}}
+
+	w := &fakeWriter{}
+	client := newFakeClient(t, w, Options{WALDirectory: dir, Columns: columns}, "logs")
+	require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1, row2}}))
+	require.Equal(t, 2, client.BufferLen())
+	require.NoError(t, client.Close())
+
+	client = newFakeClient(t, w, Options{WALDirectory: dir, Columns: columns}, "logs")
+	replayed, err := client.replay()
+	require.NoError(t, err)
+	require.Equal(t, 2, replayed)
+
+	rows := client.buffers["logs"]
+	require.Equal(t, row1, rows[0])
+	require.True(t, math.IsNaN(rows[1].FieldsNumber["latency"]))
+	require.True(t, math.IsInf(rows[1].FieldsNumber["size"], -1))
+	require.Equal(t, []any{math.Inf(1), "NaN"}, rows[1].Columns)
+	require.NoError(t, client.Close())
+}
+
+func TestBufferWALReset(t *testing.T) {
+	dir := t.TempDir()
+	row1 := Row{Log: "log1"}
+	row2 := Row{Log: "log2"}
+
+	w := &fakeWriter{}
+	client := newFakeClient(t, w, Options{WALDirectory: dir}, "logs", "audit_logs")
+	require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+
+	// Closing the log of the audit_logs table lets the append fail, so that
+	// the new row must also be removed from the log of the logs table.
+	require.NoError(t, client.wals["audit_logs"].Close())
+	require.Error(t, client.BufferAdd(map[string][]Row{"logs": {row2}, "audit_logs": {row2}}))
+	require.Equal(t, map[string][]Row{"logs": {row1}}, client.buffers)
+	require.NoError(t, client.Close())
+
+	client = newFakeClient(t, w, Options{WALDirectory: dir}, "logs", "audit_logs")
+	replayed, err := client.replay()
+	require.NoError(t, err)
+	require.Equal(t, 1, replayed)
+	require.Equal(t, map[string][]Row{"logs": {row1}}, client.buffers)
+	require.NoError(t, client.Close())
+}
+
+func TestBufferWriteRetry(t *testing.T) {
+	errConnection := fmt.Errorf("connection refused")
+	row1 := Row{Log: "log1"}
+	row2 := Row{Log: "log2"}
+	row3 := Row{Log: "log3"}
+
+	t.Run("should write rows exactly once after failures", func(t *testing.T) {
+		w := &fakeWriter{errs: []error{errConnection, errConnection}}
+		client := newFakeClient(t, w, Options{MaxAttempts: 5, RetryBackoff: time.Hour, RetryMaxBackoff: time.Hour}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.Error(t, client.BufferWrite())
+		require.True(t, client.Backoff())
+		require.Equal(t, 1, client.attempts["logs"])
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row2}}))
+		require.Error(t, client.BufferWrite())
+		require.Equal(t, 2, client.attempts["logs"])
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row3}}))
+		require.NoError(t, client.BufferWrite())
+		require.False(t, client.Backoff())
+		require.Empty(t, client.attempts)
+		require.Equal(t, 0, client.BufferLen())
+		require.Equal(t, map[string][]Row{"logs": {row1, row2, row3}}, w.written)
+
+		require.NoError(t, client.BufferWrite())
+		require.Equal(t, map[string][]Row{"logs": {row1, row2, row3}}, w.written)
+	})
+
+	t.Run("should only retry failed tables", func(t *testing.T) {
+		w := &fakeWriter{errs: []error{nil, errConnection}}
+		client := newFakeClient(t, w, Options{MaxAttempts: 5}, "logs", "audit_logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}, "audit_logs": {row2}}))
+		require.Error(t, client.BufferWrite())
+		require.Equal(t, 1, client.BufferLen())
+
+		require.NoError(t, client.BufferWrite())
+		require.Equal(t, map[string][]Row{"logs": {row1}, "audit_logs": {row2}}, w.written)
+	})
+
+	t.Run("should drop rows after max attempts", func(t *testing.T) {
+		w := &fakeWriter{errs: []error{errConnection, errConnection, errConnection}}
+		client := newFakeClient(t, w, Options{MaxAttempts: 2}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.Error(t, client.BufferWrite())
+		require.Equal(t, 1, client.BufferLen())
+		require.Error(t, client.BufferWrite())
+		require.Equal(t, 0, client.BufferLen())
+		require.Empty(t, client.attempts)
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row2}}))
+		require.Error(t, client.BufferWrite())
+		require.NoError(t, client.BufferWrite())
+		require.Equal(t, map[string][]Row{"logs": {row2}}, w.written)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	client := newFakeClient(t, &fakeWriter{}, Options{RetryBackoff: time.Second, RetryMaxBackoff: 10 * time.Second}, "logs")
+
+	for attempts, expected := range map[int]time.Duration{0: 0, 1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		client.attempts["logs"] = attempts
+		require.Equal(t, expected, client.backoff())
+	}
+}
+
+func TestBufferAddOverflow(t *testing.T) {
+	row1 := Row{Timestamp: time.Unix(1, 0), Log: "log1"}
+	row2 := Row{Timestamp: time.Unix(2, 0), Log: "log2"}
+	row3 := Row{Timestamp: time.Unix(3, 0), Log: "log3"}
+	row4 := Row{Timestamp: time.Unix(4, 0), Log: "log4"}
+
+	t.Run("should reject rows with retry policy", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 2, OverflowPolicy: OverflowPolicyRetry}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.ErrorIs(t, client.BufferAdd(map[string][]Row{"logs": {row2, row3}}), ErrBufferFull)
+		require.Equal(t, map[string][]Row{"logs": {row1}}, client.buffers)
+	})
+
+	t.Run("should reject rows when bytes are exceeded", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferBytes: 2 * row1.size()}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1, row2}}))
+		require.Equal(t, 2*row1.size(), client.bufferBytes)
+		require.ErrorIs(t, client.BufferAdd(map[string][]Row{"logs": {row3}}), ErrBufferFull)
+	})
+
+	t.Run("should drop oldest rows", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 3, OverflowPolicy: OverflowPolicyDropOldest}, "logs", "audit_logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row2}, "audit_logs": {row1}}))
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row3, row4}}))
+		require.Equal(t, 3, client.BufferLen())
+		require.Equal(t, map[string][]Row{"logs": {row2, row3, row4}, "audit_logs": {}}, client.buffers)
+	})
+
+	t.Run("should drop newest rows", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 3, OverflowPolicy: OverflowPolicyDropNewest}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1, row2}}))
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row3, row4}}))
+		require.Equal(t, map[string][]Row{"logs": {row1, row2, row3}}, client.buffers)
+	})
+
+	t.Run("should update size after write", func(t *testing.T) {
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 2}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1, row2}}))
+		require.NoError(t, client.BufferWrite())
+		require.Equal(t, 0, client.BufferLen())
+		require.Equal(t, int64(0), client.bufferBytes)
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row3, row4}}))
+	})
+
+	t.Run("should not change buffer when write-ahead log is full", func(t *testing.T) {
+		record, err := json.Marshal(row1)
+		require.NoError(t, err)
+		walMaxSize := int64(2 * (8 + len(record)))
+
+		for _, policy := range []string{OverflowPolicyRetry, OverflowPolicyDropOldest, OverflowPolicyDropNewest} {
+			client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 2, OverflowPolicy: policy, WALDirectory: t.TempDir(), WALMaxSize: walMaxSize}, "logs")
+
+			require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1, row2}}))
+			err := client.BufferAdd(map[string][]Row{"logs": {row3}})
+			if policy == OverflowPolicyRetry {
+				require.ErrorIs(t, err, ErrBufferFull)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, map[string][]Row{"logs": {row1, row2}}, client.buffers, policy)
+			require.Equal(t, walMaxSize, client.wals["logs"].Size(), policy)
+			require.NoError(t, client.Close())
+		}
+	})
+
+	t.Run("should reject rows when write-ahead log is full", func(t *testing.T) {
+		record, err := json.Marshal(row1)
+		require.NoError(t, err)
+
+		client := newFakeClient(t, &fakeWriter{}, Options{WALDirectory: t.TempDir(), WALMaxSize: int64(2 * (8 + len(record)))}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.ErrorIs(t, client.BufferAdd(map[string][]Row{"logs": {row2, row3}}), wal.ErrFull)
+		require.Equal(t, map[string][]Row{"logs": {row1}}, client.buffers)
+		require.NoError(t, client.Close())
+	})
+
+	t.Run("should drop new rows which do not fit into write-ahead log", func(t *testing.T) {
+		record, err := json.Marshal(row1)
+		require.NoError(t, err)
+
+		client := newFakeClient(t, &fakeWriter{}, Options{MaxBufferRows: 3, OverflowPolicy: OverflowPolicyDropOldest, WALDirectory: t.TempDir(), WALMaxSize: int64(3 * (8 + len(record)))}, "logs")
+
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row1}}))
+		require.NoError(t, client.BufferAdd(map[string][]Row{"logs": {row2, row3, row4}}))
+		require.Equal(t, map[string][]Row{"logs": {row1, row2, row3}}, client.buffers)
+		require.NoError(t, client.Close())
+	})
+
+	t.Run("should fail for invalid policy", func(t *testing.T) {
+		_, err := newClient(&fakeWriter{}, []string{"logs"}, Options{OverflowPolicy: "invalid"})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,184 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The following types are supported for dedicated columns.
+const (
+	ColumnTypeString               = "String"
+	ColumnTypeLowCardinalityString = "LowCardinality(String)"
+	ColumnTypeFloat64              = "Float64"
+	ColumnTypeInt64                = "Int64"
+	ColumnTypeUInt64               = "UInt64"
+	ColumnTypeBool                 = "Bool"
+)
+
+// FieldsOptions defines which optional columns for the fields of a row are
+// written. If Bool is enabled, the fields_bool column is written and if Array
+// is enabled, the fields_array column is written.
+type FieldsOptions struct {
+	Bool  bool
+	Array bool
+}
+
+// Column is a dedicated column in ClickHouse for a field of a record. The key
+// is the flattened key of the field, the name is the name of the column and
+// the type must be one of the supported column types.
+type Column struct {
+	Key  string
+	Name string
+	Type string
+}
+
+// ParseColumns parses the provided columns, which must be a comma separated
+// list of columns in the format "<key> => <name> <type>", e.g.
+// "content_level => content_level String, content_response_code => response_code Float64".
+func ParseColumns(columns string) ([]Column, error) {
+	var parsedColumns []Column
+
+	for _, c := range strings.Split(columns, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		key, definition, ok := strings.Cut(c, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid column %q, must be in the format \"<key> => <name> <type>\"", c)
+		}
+
+		definitionParts := strings.Fields(definition)
+		if strings.TrimSpace(key) == "" || len(definitionParts) != 2 {
+			return nil, fmt.Errorf("invalid column %q, must be in the format \"<key> => <name> <type>\"", c)
+		}
+
+		column := Column{Key: strings.TrimSpace(key), Name: definitionParts[0], Type: definitionParts[1]}
+		if err := validateIdentifier("column", column.Name); err != nil {
+			return nil, err
+		}
+
+		switch column.Type {
+		case ColumnTypeString, ColumnTypeLowCardinalityString, ColumnTypeFloat64, ColumnTypeInt64, ColumnTypeUInt64, ColumnTypeBool:
+		default:
+			return nil, fmt.Errorf("invalid type %q for column %s", column.Type, column.Name)
+		}
+
+		for _, parsedColumn := range parsedColumns {
+			if parsedColumn.Name == column.Name {
+				return nil, fmt.Errorf("duplicate column %s", column.Name)
+			}
+		}
+
+		reservedColumns := append(append(rowColumns, jsonRowColumns...), fieldsColumns(FieldsOptions{Bool: true, Array: true})...)
+		for _, c := range reservedColumns {
+			if c.name == column.Name {
+				return nil, fmt.Errorf("column %s is already used", column.Name)
+			}
+		}
+
+		parsedColumns = append(parsedColumns, column)
+	}
+
+	return parsedColumns, nil
+}
+
+// Value converts the provided value of a field to the type of the column. If
+// the value is nil or can not be converted, the zero value of the type is
+// returned.
+func (c Column) Value(v any) any {
+	switch c.Type {
+	case ColumnTypeFloat64:
+		return toFloat64(v)
+	case ColumnTypeInt64:
+		// Integers are converted directly, so that we do not lose precision
+		// for large values by converting them to a float64 first.
+		switch t := v.(type) {
+		case int64:
+			return t
+		case string:
+			if value, err := strconv.ParseInt(t, 10, 64); err == nil {
+				return value
+			}
+		}
+
+		return int64(toFloat64(v))
+	case ColumnTypeUInt64:
+		switch t := v.(type) {
+		case uint64:
+			return t
+		case string:
+			if value, err := strconv.ParseUint(t, 10, 64); err == nil {
+				return value
+			}
+		}
+
+		value := toFloat64(v)
+		if value < 0 {
+			return uint64(0)
+		}
+		return uint64(value)
+	case ColumnTypeBool:
+		switch t := v.(type) {
+		case bool:
+			return t
+		case string:
+			value, _ := strconv.ParseBool(t)
+			return value
+		default:
+			return toFloat64(v) != 0
+		}
+	default:
+		switch t := v.(type) {
+		case nil:
+			return ""
+		case string:
+			return t
+		case []byte:
+			return string(t)
+		default:
+			return fmt.Sprintf("%v", v)
+		}
+	}
+}
+
+// toFloat64 converts the provided value to a float64. If the value can not be
+// converted, 0 is returned.
+func toFloat64(v any) float64 {
+	switch t := v.(type) {
+	case int:
+		return float64(t)
+	case int8:
+		return float64(t)
+	case int16:
+		return float64(t)
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint:
+		return float64(t)
+	case uint8:
+		return float64(t)
+	case uint16:
+		return float64(t)
+	case uint32:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	case float64:
+		return t
+	case string:
+		value, _ := strconv.ParseFloat(t, 64)
+		return value
+	case []byte:
+		value, _ := strconv.ParseFloat(string(t), 64)
+		return value
+	default:
+		return 0
+	}
+}
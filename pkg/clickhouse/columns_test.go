@@ -0,0 +1,135 @@
+package clickhouse
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseColumns(t *testing.T) {
+	t.Run("should parse columns", func(t *testing.T) {
+		columns, err := ParseColumns("content_level => content_level String, content_response_code => response_code Float64,content_ok=>ok Bool")
+		require.NoError(t, err)
+		require.Equal(t, []Column{
+			{Key: "content_level", Name: "content_level", Type: ColumnTypeString},
+			{Key: "content_response_code", Name: "response_code", Type: ColumnTypeFloat64},
+			{Key: "content_ok", Name: "ok", Type: ColumnTypeBool},
+		}, columns)
+	})
+
+	t.Run("should return no columns for empty string", func(t *testing.T) {
+		columns, err := ParseColumns("")
+		require.NoError(t, err)
+		require.Empty(t, columns)
+	})
+
+	for _, columns := range []string{
+		"content_level",
+		"content_level => content_level",
+		" => content_level String",
+		"content_level => content-level String",
+		"content_level => content_level Map(String, String)",
+		"content_level => content_level DateTime",
+		"content_level => level String, content_severity => level String",
+		"content_namespace => namespace String",
+		"content_ok => fields_bool Bool",
+		"content_tags => fields_array String",
+	} {
+		t.Run("should fail for "+columns, func(t *testing.T) {
+			_, err := ParseColumns(columns)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestColumnValue(t *testing.T) {
+	for _, tc := range []struct {
+		typ      string
+		value    any
+		expected any
+	}{
+		{typ: ColumnTypeString, value: "info", expected: "info"},
+		{typ: ColumnTypeString, value: []byte("info"), expected: "info"},
+		{typ: ColumnTypeString, value: int64(200), expected: "200"},
+		{typ: ColumnTypeString, value: nil, expected: ""},
+		{typ: ColumnTypeLowCardinalityString, value: "info", expected: "info"},
+		{typ: ColumnTypeFloat64, value: int64(200), expected: float64(200)},
+		{typ: ColumnTypeFloat64, value: "1.5", expected: float64(1.5)},
+		{typ: ColumnTypeFloat64, value: "invalid", expected: float64(0)},
+		{typ: ColumnTypeInt64, value: int64(9007199254740993), expected: int64(9007199254740993)},
+		{typ: ColumnTypeInt64, value: "-42", expected: int64(-42)},
+		{typ: ColumnTypeInt64, value: float64(42), expected: int64(42)},
+		{typ: ColumnTypeInt64, value: nil, expected: int64(0)},
+		{typ: ColumnTypeUInt64, value: uint64(42), expected: uint64(42)},
+		{typ: ColumnTypeUInt64, value: int64(-1), expected: uint64(0)},
+		{typ: ColumnTypeUInt64, value: "42", expected: uint64(42)},
+		{typ: ColumnTypeBool, value: true, expected: true},
+		{typ: ColumnTypeBool, value: "true", expected: true},
+		{typ: ColumnTypeBool, value: int64(0), expected: false},
+	} {
+		t.Run(fmt.Sprintf("should convert %v to %s", tc.value, tc.typ), func(t *testing.T) {
+			require.Equal(t, tc.expected, Column{Type: tc.typ}.Value(tc.value))
+		})
+	}
+}
+
+func TestInsertQuery(t *testing.T) {
+	require.Equal(t, "INSERT INTO `logs`.`logs` (timestamp, cluster, namespace, app, pod_name, container_name, host, fields_string, fields_number, log)", insertQuery("logs", "logs", "", FieldsOptions{}, nil))
+	require.Equal(t, "INSERT INTO `logs`.`logs` (timestamp, cluster, namespace, app, pod_name, container_name, host, fields_string, fields_number, log, `content_level`, `response_code`)", insertQuery("logs", "logs", "", FieldsOptions{}, []Column{{Key: "content_level", Name: "content_level", Type: ColumnTypeString}, {Key: "content_response_code", Name: "response_code", Type: ColumnTypeInt64}}))
+	require.Equal(t, "INSERT INTO `logs`.`logs` (timestamp, cluster, namespace, app, pod_name, container_name, host, fields_string, fields_number, log, fields_bool, fields_array, `content_level`)", insertQuery("logs", "logs", "", FieldsOptions{Bool: true, Array: true}, []Column{{Key: "content_level", Name: "content_level", Type: ColumnTypeString}}))
+	require.Equal(t, "INSERT INTO `logs`.`logs` (timestamp, cluster, namespace, app, pod_name, container_name, host, fields_string, fields_number, log, fields_array)", insertQuery("logs", "logs", "", FieldsOptions{Array: true}, nil))
+	require.Equal(t, "INSERT INTO `logs`.`logs` (timestamp, cluster, namespace, app, pod_name, container_name, host, fields, log, `content_level`)", insertQuery("logs", "logs", StorageLayoutJSON, FieldsOptions{}, []Column{{Key: "content_level", Name: "content_level", Type: ColumnTypeString}}))
+}
+
+func TestInsertValues(t *testing.T) {
+	row := Row{
+		Log:         "log1",
+		FieldsBool:  map[string]bool{"content_success": true},
+		FieldsArray: map[string][]string{"content_tags": {"a", "b"}},
+		Columns:     []any{"info"},
+	}
+
+	t.Run("should not return fields columns when disabled", func(t *testing.T) {
+		values := insertValues(row, "", FieldsOptions{})
+		require.Len(t, values, 11)
+		require.Equal(t, "info", values[10])
+	})
+
+	t.Run("should return fields columns when enabled", func(t *testing.T) {
+		values := insertValues(row, "", FieldsOptions{Bool: true, Array: true})
+		require.Len(t, values, 13)
+		require.Equal(t, row.FieldsBool, values[10])
+		require.Equal(t, row.FieldsArray, values[11])
+		require.Equal(t, "info", values[12])
+	})
+
+	t.Run("should return json fields for json storage layout", func(t *testing.T) {
+		values := insertValues(Row{Log: "log1", Fields: `{"content":{"level":"info"}}`, Columns: []any{"info"}}, StorageLayoutJSON, FieldsOptions{})
+		require.Len(t, values, 10)
+		require.Equal(t, `{"content":{"level":"info"}}`, values[7])
+		require.Equal(t, "log1", values[8])
+		require.Equal(t, "info", values[9])
+	})
+}
+
+func TestBufferWALReplayColumns(t *testing.T) {
+	dir := t.TempDir()
+	columns := []Column{{Key: "content_level", Name: "content_level", Type: ColumnTypeString}, {Key: "content_response_code", Name: "response_code", Type: ColumnTypeInt64}}
+	row := Row{Timestamp: time.Unix(1, 0).UTC(), FieldsString: map[string]string{}, FieldsNumber: map[string]float64{}, Log: "log1", FieldsBool: map[string]bool{"content_success": true}, FieldsArray: map[string][]string{"content_tags": {"a", "b"}}, Columns: []any{"info", int64(200)}}
+
+	w := &fakeWriter{errs: []error{fmt.Errorf("connection refused")}}
+	client := newFakeClient(t, w, Options{WALDirectory: dir, Columns: columns}, "logs")
+	require.NoError(t, client.BufferAdd(map[string][]Row{"": {row}}))
+	require.Error(t, client.BufferWrite())
+	require.NoError(t, client.Close())
+
+	client = newFakeClient(t, w, Options{WALDirectory: dir, Columns: columns}, "logs")
+	replayed, err := client.replay()
+	require.NoError(t, err)
+	require.Equal(t, 1, replayed)
+	require.NoError(t, client.BufferWrite())
+	require.Equal(t, map[string][]Row{"logs": {row}}, w.written)
+	require.NoError(t, client.Close())
+}
@@ -0,0 +1,128 @@
+package clickhouse
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// CompressionNone disables the compression of the data sent to ClickHouse.
+	// This is the default compression method.
+	CompressionNone = "none"
+	// CompressionLZ4 compresses the data sent to ClickHouse via LZ4.
+	CompressionLZ4 = "lz4"
+	// CompressionZSTD compresses the data sent to ClickHouse via ZSTD.
+	CompressionZSTD = "zstd"
+	// CompressionGZIP compresses the data sent to ClickHouse via GZIP.
+	CompressionGZIP = "gzip"
+	// CompressionBrotli compresses the data sent to ClickHouse via Brotli.
+	CompressionBrotli = "brotli"
+)
+
+// newCompression returns the compression settings for clickhouse-go for the
+// provided method and level. The native protocol only supports LZ4 and ZSTD,
+// while the HTTP protocol also supports GZIP and Brotli.
+func newCompression(protocol clickhouse.Protocol, method string, level int) (*clickhouse.Compression, error) {
+	switch method {
+	case "", CompressionNone:
+		return &clickhouse.Compression{Method: clickhouse.CompressionNone}, nil
+	case CompressionLZ4:
+		return &clickhouse.Compression{Method: clickhouse.CompressionLZ4, Level: level}, nil
+	case CompressionZSTD:
+		return &clickhouse.Compression{Method: clickhouse.CompressionZSTD, Level: level}, nil
+	case CompressionGZIP:
+		if protocol != clickhouse.HTTP {
+			return nil, fmt.Errorf("compression method %s is only supported by the http protocol", method)
+		}
+		// A level of 0 means no compression for GZIP, so that we use the
+		// default level of GZIP instead.
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return &clickhouse.Compression{Method: clickhouse.CompressionGZIP, Level: level}, nil
+	case CompressionBrotli:
+		if protocol != clickhouse.HTTP {
+			return nil, fmt.Errorf("compression method %s is only supported by the http protocol", method)
+		}
+		return &clickhouse.Compression{Method: clickhouse.CompressionBrotli, Level: level}, nil
+	default:
+		return nil, fmt.Errorf("invalid compression method %s", method)
+	}
+}
+
+// countingConn wraps a connection to ClickHouse and counts the bytes which are
+// written to the connection.
+type countingConn struct {
+	net.Conn
+	sent prometheus.Counter
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(float64(n))
+	return n, err
+}
+
+// newDialContext returns the function, which is used by clickhouse-go to
+// connect to ClickHouse. The connection is wrapped, so that the number of
+// bytes sent to ClickHouse after compression can be exposed as metric. Because
+// clickhouse-go ignores the TLS configuration when a custom dial function is
+// set, the TLS handshake is also done here.
+func newDialContext(name string, dialTimeout time.Duration, tlsConfig *tls.Config) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		countedConn := &countingConn{Conn: conn, sent: sentBytesTotalMetric.WithLabelValues(name)}
+		if tlsConfig == nil {
+			return countedConn, nil
+		}
+
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			config.ServerName = host
+
+			// The server name of the connection state is empty, when the host
+			// is an IP address, because no SNI is sent for IP addresses. To
+			// verify the server certificate against the CA file, we use the
+			// host of the address as expected server name instead.
+			if verifyConnection := config.VerifyConnection; verifyConnection != nil {
+				config.VerifyConnection = func(cs tls.ConnectionState) error {
+					if cs.ServerName == "" {
+						cs.ServerName = host
+					}
+					return verifyConnection(cs)
+				}
+			}
+		}
+
+		if dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+		}
+
+		tlsConn := tls.Client(countedConn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,160 @@
+package clickhouse
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCompression(t *testing.T) {
+	for _, tc := range []struct {
+		protocol clickhouse.Protocol
+		method   string
+		level    int
+		expected *clickhouse.Compression
+	}{
+		{protocol: clickhouse.Native, method: "", expected: &clickhouse.Compression{Method: clickhouse.CompressionNone}},
+		{protocol: clickhouse.Native, method: CompressionNone, expected: &clickhouse.Compression{Method: clickhouse.CompressionNone}},
+		{protocol: clickhouse.Native, method: CompressionLZ4, expected: &clickhouse.Compression{Method: clickhouse.CompressionLZ4}},
+		{protocol: clickhouse.Native, method: CompressionZSTD, level: 3, expected: &clickhouse.Compression{Method: clickhouse.CompressionZSTD, Level: 3}},
+		{protocol: clickhouse.HTTP, method: CompressionGZIP, expected: &clickhouse.Compression{Method: clickhouse.CompressionGZIP, Level: -1}},
+		{protocol: clickhouse.HTTP, method: CompressionGZIP, level: 9, expected: &clickhouse.Compression{Method: clickhouse.CompressionGZIP, Level: 9}},
+		{protocol: clickhouse.HTTP, method: CompressionBrotli, level: 5, expected: &clickhouse.Compression{Method: clickhouse.CompressionBrotli, Level: 5}},
+	} {
+		t.Run("should return compression for "+tc.protocol.String()+" "+tc.method, func(t *testing.T) {
+			compression, err := newCompression(tc.protocol, tc.method, tc.level)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, compression)
+		})
+	}
+
+	t.Run("should fail for compression methods which are not supported by the native protocol", func(t *testing.T) {
+		_, err := newCompression(clickhouse.Native, CompressionGZIP, 0)
+		require.Error(t, err)
+
+		_, err = newCompression(clickhouse.Native, CompressionBrotli, 0)
+		require.Error(t, err)
+	})
+
+	t.Run("should fail for invalid compression method", func(t *testing.T) {
+		_, err := newCompression(clickhouse.Native, "invalid", 0)
+		require.Error(t, err)
+	})
+}
+
+func TestNewDialContext(t *testing.T) {
+	t.Run("should count sent bytes", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		received := make(chan []byte)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			data, _ := io.ReadAll(conn)
+			received <- data
+		}()
+
+		sent := testutil.ToFloat64(sentBytesTotalMetric.WithLabelValues("test-dial"))
+		conn, err := newDialContext("test-dial", time.Second, nil)(context.Background(), listener.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello world"))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		require.Equal(t, []byte("hello world"), <-received)
+		require.Equal(t, sent+11, testutil.ToFloat64(sentBytesTotalMetric.WithLabelValues("test-dial")))
+	})
+
+	t.Run("should do tls handshake", func(t *testing.T) {
+		dir := t.TempDir()
+		ca := newTestCertificate(t, "ca", nil)
+		server := newTestCertificate(t, "localhost", ca)
+		writeFile(t, filepath.Join(dir, "ca.pem"), ca.certPEM, time.Now())
+
+		serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+		require.NoError(t, err)
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12})
+		require.NoError(t, err)
+		defer listener.Close()
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		require.NoError(t, err)
+
+		config, err := newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem")})
+		require.NoError(t, err)
+
+		sent := testutil.ToFloat64(sentBytesTotalMetric.WithLabelValues("test-dial-tls"))
+		conn, err := newDialContext("test-dial-tls", time.Second, config)(context.Background(), net.JoinHostPort("localhost", port))
+		require.NoError(t, err)
+		require.IsType(t, &tls.Conn{}, conn)
+		require.NoError(t, conn.Close())
+		require.Greater(t, testutil.ToFloat64(sentBytesTotalMetric.WithLabelValues("test-dial-tls")), sent)
+	})
+
+	t.Run("should verify ip address with ca file", func(t *testing.T) {
+		dir := t.TempDir()
+		ca := newTestCertificate(t, "ca", nil)
+		writeFile(t, filepath.Join(dir, "ca.pem"), ca.certPEM, time.Now())
+
+		config, err := newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem")})
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			commonName string
+			valid      bool
+		}{
+			{commonName: "127.0.0.1", valid: true},
+			{commonName: "127.0.0.2", valid: false},
+		} {
+			server := newTestCertificate(t, tc.commonName, ca)
+			serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+			require.NoError(t, err)
+
+			listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12})
+			require.NoError(t, err)
+			defer listener.Close()
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+
+			conn, err := newDialContext("test-dial-tls-ip", time.Second, config)(context.Background(), listener.Addr().String())
+			if !tc.valid {
+				require.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+		}
+	})
+}
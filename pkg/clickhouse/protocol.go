@@ -0,0 +1,134 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const (
+	// ProtocolNative uses the native TCP protocol of ClickHouse. This is the
+	// default protocol.
+	ProtocolNative = "native"
+	// ProtocolHTTP uses the HTTP interface of ClickHouse, e.g. when ClickHouse
+	// is only reachable via a HTTP load balancer.
+	ProtocolHTTP = "http"
+)
+
+// newProtocol returns the clickhouse-go protocol for the provided protocol.
+func newProtocol(protocol string) (clickhouse.Protocol, error) {
+	switch protocol {
+	case "", ProtocolNative:
+		return clickhouse.Native, nil
+	case ProtocolHTTP:
+		return clickhouse.HTTP, nil
+	default:
+		return clickhouse.Native, fmt.Errorf("invalid protocol %s", protocol)
+	}
+}
+
+// newHTTPProxyURL parses the provided proxy URL. If no proxy URL is provided,
+// nil is returned, so that the proxy from the environment is used.
+func newHTTPProxyURL(proxyURL string) (*url.URL, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+
+	parsedProxyURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedProxyURL.Scheme == "" || parsedProxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %s", proxyURL)
+	}
+
+	return parsedProxyURL, nil
+}
+
+// newHTTPTransportFunc returns the function, which is used to adjust the HTTP
+// transport of clickhouse-go, when TLS is enabled. The TLS connections are
+// established by the provided dial function instead of the transport, so that
+// the server certificate is verified against the host of the address, also
+// when it is an IP address for which no SNI is sent. Connections via a HTTP
+// proxy are still established by the transport.
+func newHTTPTransportFunc(dialTLSContext func(ctx context.Context, addr string) (net.Conn, error)) func(*http.Transport) (http.RoundTripper, error) {
+	return func(transport *http.Transport) (http.RoundTripper, error) {
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLSContext(ctx, addr)
+		}
+		return transport, nil
+	}
+}
+
+// validateHTTPProxyTLS returns an error, when the server certificate must be
+// verified against the CA file for an IP address, which is reached via a HTTP
+// proxy. In this case the TLS handshake is done by the transport of
+// clickhouse-go, which doesn't send the IP address as server name, so that the
+// server name must be configured explicitly. If no proxy URL is provided, the
+// proxy from the environment is checked.
+func validateHTTPProxyTLS(addresses []string, proxyURL *url.URL, options TLSOptions) error {
+	if !options.Enabled || options.CAFile == "" || options.InsecureSkipVerify || options.ServerName != "" {
+		return nil
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	for _, address := range addresses {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		if net.ParseIP(host) == nil {
+			continue
+		}
+
+		addressProxyURL, err := proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+		if err != nil {
+			return err
+		}
+
+		if addressProxyURL != nil {
+			return fmt.Errorf("tls server name is required to verify the certificate of %s via the http proxy", address)
+		}
+	}
+
+	return nil
+}
+
+// newHTTPHeaders parses the provided headers, which must be a comma separated
+// list of headers in the format "<name>: <value>". If a username is provided,
+// the "Authorization" header for basic authentication is added to the headers.
+func newHTTPHeaders(headers, username, password string) (map[string]string, error) {
+	parsedHeaders := make(map[string]string)
+
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, must be in the format \"<name>: <value>\"", header)
+		}
+
+		parsedHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	if username != "" {
+		parsedHeaders["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	return parsedHeaders, nil
+}
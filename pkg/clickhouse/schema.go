@@ -0,0 +1,421 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const (
+	// defaultPartitionBy is the partition key of the created tables, when no
+	// partition key is configured.
+	defaultPartitionBy = "toDate(timestamp)"
+	// defaultOrderBy is the sorting key of the created tables, when no sorting
+	// key is configured.
+	defaultOrderBy = "(cluster, namespace, app, pod_name, container_name, host, timestamp)"
+)
+
+const (
+	// StorageLayoutClassic writes the flattened fields of a record to the
+	// fields_string and fields_number columns. This is the default storage
+	// layout.
+	StorageLayoutClassic = "classic"
+	// StorageLayoutJSON writes the nested record to the fields column with the
+	// JSON type.
+	StorageLayoutJSON = "json"
+)
+
+const (
+	// SchemaVerifyNone disables the verification of the schema.
+	SchemaVerifyNone = "none"
+	// SchemaVerifyWarn logs a warning for each column, which doesn't match the
+	// expected schema. This is the default verification mode.
+	SchemaVerifyWarn = "warn"
+	// SchemaVerifyError returns an error, when a column doesn't match the
+	// expected schema, so that the plugin isn't started.
+	SchemaVerifyError = "error"
+)
+
+// The following error codes are returned by ClickHouse, when a database or
+// table is created concurrently by another client, even if the statement
+// contains "IF NOT EXISTS".
+const (
+	errCodeTableAlreadyExists    = 57
+	errCodeDatabaseAlreadyExists = 82
+	errCodeReplicaAlreadyExists  = 253
+)
+
+// column is a column, which is written by the client. The type is used to
+// create the column and to verify the existing column. The codec is only used
+// to create the column.
+type column struct {
+	name  string
+	typ   string
+	codec string
+}
+
+// rowColumns are the columns for the fields of a row, which are written by the
+// client. They must be kept in sync with the insertQuery function.
+var rowColumns = []column{
+	{name: "timestamp", typ: "DateTime64(3)", codec: "CODEC(Delta, LZ4)"},
+	{name: "cluster", typ: "LowCardinality(String)"},
+	{name: "namespace", typ: "LowCardinality(String)"},
+	{name: "app", typ: "LowCardinality(String)"},
+	{name: "pod_name", typ: "LowCardinality(String)"},
+	{name: "container_name", typ: "LowCardinality(String)"},
+	{name: "host", typ: "LowCardinality(String)"},
+	{name: "fields_string", typ: "Map(LowCardinality(String), String)"},
+	{name: "fields_number", typ: "Map(LowCardinality(String), Float64)"},
+	{name: "log", typ: "String", codec: "CODEC(ZSTD(1))"},
+}
+
+// jsonRowColumns are the columns for the fields of a row, which are written by
+// the client when the json storage layout is used. They must be kept in sync
+// with the insertValues function.
+var jsonRowColumns = []column{
+	{name: "timestamp", typ: "DateTime64(3)", codec: "CODEC(Delta, LZ4)"},
+	{name: "cluster", typ: "LowCardinality(String)"},
+	{name: "namespace", typ: "LowCardinality(String)"},
+	{name: "app", typ: "LowCardinality(String)"},
+	{name: "pod_name", typ: "LowCardinality(String)"},
+	{name: "container_name", typ: "LowCardinality(String)"},
+	{name: "host", typ: "LowCardinality(String)"},
+	{name: "fields", typ: "JSON"},
+	{name: "log", typ: "String", codec: "CODEC(ZSTD(1))"},
+}
+
+// layoutColumns returns the columns for the fields of a row for the provided
+// storage layout.
+func layoutColumns(storageLayout string) []column {
+	if storageLayout == StorageLayoutJSON {
+		return jsonRowColumns
+	}
+
+	return rowColumns
+}
+
+// validateStorageLayout validates the provided storage layout. The optional
+// fields columns can only be used with the classic storage layout, because the
+// json storage layout keeps the type of all values.
+func validateStorageLayout(storageLayout string, fields FieldsOptions) error {
+	switch storageLayout {
+	case StorageLayoutClassic, "":
+		return nil
+	case StorageLayoutJSON:
+		if fields.Bool || fields.Array {
+			return fmt.Errorf("the fields_bool and fields_array columns can not be used with the %q storage layout", StorageLayoutJSON)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid storage layout %q: must be %q or %q", storageLayout, StorageLayoutClassic, StorageLayoutJSON)
+	}
+}
+
+// columnsDefinition returns the definition of the provided columns, which can
+// be used in a CREATE TABLE statement.
+func columnsDefinition(columns []column) string {
+	definitions := make([]string, 0, len(columns))
+	for _, c := range columns {
+		definition := fmt.Sprintf("    %s %s", quoteIdentifier(c.name), c.typ)
+		if c.codec != "" {
+			definition = definition + " " + c.codec
+		}
+		definitions = append(definitions, definition)
+	}
+
+	return "(\n" + strings.Join(definitions, ",\n") + "\n)"
+}
+
+// fieldsColumns returns the enabled optional columns for the fields of a row.
+// They must be kept in sync with the insertValues function.
+func fieldsColumns(fields FieldsOptions) []column {
+	var columns []column
+	if fields.Bool {
+		columns = append(columns, column{name: "fields_bool", typ: "Map(LowCardinality(String), Bool)"})
+	}
+	if fields.Array {
+		columns = append(columns, column{name: "fields_array", typ: "Map(LowCardinality(String), Array(String))"})
+	}
+
+	return columns
+}
+
+// tableColumns returns all columns, which are written by the client. These are
+// the columns of a row for the storage layout, the enabled fields columns and
+// the configured dedicated columns.
+func tableColumns(storageLayout string, fields FieldsOptions, dedicatedColumns []Column) []column {
+	columns := append([]column{}, layoutColumns(storageLayout)...)
+	columns = append(columns, fieldsColumns(fields)...)
+	for _, c := range dedicatedColumns {
+		columns = append(columns, column{name: c.Name, typ: c.Type})
+	}
+
+	return columns
+}
+
+// SchemaOptions contains the options to create the database and tables, when
+// the client is created.
+//
+// If a cluster is configured, the rows are stored in a ReplicatedMergeTree
+// table with the suffix "_local" on each node of the cluster and the client
+// writes to a Distributed table with the name of the configured table. If no
+// cluster is configured, the rows are stored in a MergeTree table with the
+// name of the configured table.
+//
+// The verification mode defines what happens, when the existing tables do not
+// match the columns which are written by the client.
+type SchemaOptions struct {
+	Create      bool
+	Verify      string
+	Cluster     string
+	TTL         string
+	PartitionBy string
+	OrderBy     string
+}
+
+// quoteString returns the provided value as SQL string literal.
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// schemaQueries returns the statements to create the database and the tables
+// for the provided table. All statements can be executed multiple times.
+func schemaQueries(database, table string, columns []column, options SchemaOptions) []string {
+	partitionBy := options.PartitionBy
+	if partitionBy == "" {
+		partitionBy = defaultPartitionBy
+	}
+
+	orderBy := options.OrderBy
+	if orderBy == "" {
+		orderBy = defaultOrderBy
+	}
+
+	var ttl string
+	if options.TTL != "" {
+		ttl = fmt.Sprintf("\nTTL %s", options.TTL)
+	}
+
+	if options.Cluster == "" {
+		return []string{
+			fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteIdentifier(database)),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s\n%s\nENGINE = MergeTree\nPARTITION BY %s\nORDER BY %s%s", quoteIdentifier(database), quoteIdentifier(table), columnsDefinition(columns), partitionBy, orderBy, ttl),
+		}
+	}
+
+	onCluster := fmt.Sprintf(" ON CLUSTER %s", quoteIdentifier(options.Cluster))
+	localTable := table + "_local"
+
+	return []string{
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s", quoteIdentifier(database), onCluster),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s\n%s\nENGINE = ReplicatedMergeTree\nPARTITION BY %s\nORDER BY %s%s", quoteIdentifier(database), quoteIdentifier(localTable), onCluster, columnsDefinition(columns), partitionBy, orderBy, ttl),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s AS %s.%s\nENGINE = Distributed(%s, %s, %s, rand())", quoteIdentifier(database), quoteIdentifier(table), onCluster, quoteIdentifier(database), quoteIdentifier(localTable), quoteString(options.Cluster), quoteString(database), quoteString(localTable)),
+	}
+}
+
+// tableExists returns true, when the provided table exists in the database.
+func tableExists(ctx context.Context, w writer, database, table string) (bool, error) {
+	rows, err := w.query(ctx, "SELECT count() FROM system.tables WHERE database = ? AND name = ?", database, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var count uint64
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return false, err
+		}
+	}
+
+	return count > 0, rows.Err()
+}
+
+// isAlreadyExists returns true, when the provided error is returned by
+// ClickHouse because a database or table was created concurrently.
+func isAlreadyExists(err error) bool {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return false
+	}
+
+	switch exception.Code {
+	case errCodeTableAlreadyExists, errCodeDatabaseAlreadyExists, errCodeReplicaAlreadyExists:
+		return true
+	default:
+		return false
+	}
+}
+
+// createSchema creates the database and the tables for all provided tables.
+//
+// Because the schema is created by each Fluent Bit pod on startup, we check
+// if a table already exists before the statements are executed. This avoids
+// that many "ON CLUSTER" statements are added to the distributed DDL queue,
+// when a large number of pods is started at the same time. If a database or
+// table is created concurrently by another pod, the returned error is
+// ignored.
+func createSchema(ctx context.Context, w writer, database string, tables []string, columns []column, options SchemaOptions, logger *slog.Logger) error {
+	for _, table := range tables {
+		exists, err := tableExists(ctx, w, database, table)
+		if err != nil {
+			return fmt.Errorf("failed to check if table %s exists: %w", table, err)
+		}
+
+		if exists {
+			logger.Debug("Table already exists, skip schema creation", slog.String("database", database), slog.String("table", table))
+			continue
+		}
+
+		for _, query := range schemaQueries(database, table, columns, options) {
+			if err := w.exec(ctx, query); err != nil && !isAlreadyExists(err) {
+				return fmt.Errorf("failed to create schema for table %s: %w", table, err)
+			}
+		}
+
+		logger.Info("Schema created", slog.String("database", database), slog.String("table", table), slog.String("cluster", options.Cluster))
+	}
+
+	return nil
+}
+
+// unwrapType removes all occurrences of the provided wrapper from the type,
+// e.g. "Map(LowCardinality(String), String)" becomes "Map(String, String)" for
+// the "LowCardinality" wrapper.
+func unwrapType(typ, wrapper string) string {
+	prefix := wrapper + "("
+
+	for {
+		start := strings.Index(typ, prefix)
+		if start == -1 {
+			return typ
+		}
+
+		depth := 0
+		end := -1
+		for i := start + len(prefix) - 1; i < len(typ); i++ {
+			if typ[i] == '(' {
+				depth++
+			} else if typ[i] == ')' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+
+		if end == -1 {
+			return typ
+		}
+
+		typ = typ[:start] + typ[start+len(prefix):end] + typ[end+1:]
+	}
+}
+
+// normalizeType returns the type in a form, which can be compared with the
+// type of another column. The client can write to a column regardless of the
+// "LowCardinality" and "Nullable" wrappers and the precision and timezone of a
+// "DateTime" column, so that they are ignored.
+func normalizeType(typ string) string {
+	typ = unwrapType(typ, "LowCardinality")
+	typ = unwrapType(typ, "Nullable")
+
+	if strings.HasPrefix(typ, "DateTime") {
+		return "DateTime"
+	}
+
+	// The JSON type can contain parameters, e.g. the maximum number of dynamic
+	// paths, which are not relevant for the client.
+	if strings.HasPrefix(typ, "JSON") {
+		return "JSON"
+	}
+
+	return typ
+}
+
+// diffSchema compares the columns of the provided table in ClickHouse with the
+// columns which are written by the client and returns a description for each
+// column, which is missing or has an incompatible type. Additional columns in
+// ClickHouse are ignored.
+func diffSchema(ctx context.Context, w writer, database, table string, columns []column) ([]string, error) {
+	rows, err := w.query(ctx, "SELECT name, type FROM system.columns WHERE database = ? AND table = ?", database, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existingColumns := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		existingColumns[name] = typ
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(existingColumns) == 0 {
+		return []string{fmt.Sprintf("table %s.%s does not exist", database, table)}, nil
+	}
+
+	var diff []string
+	for _, c := range columns {
+		typ, ok := existingColumns[c.name]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("column %s is missing, expected type %s", c.name, c.typ))
+			continue
+		}
+
+		if normalizeType(typ) != normalizeType(c.typ) {
+			diff = append(diff, fmt.Sprintf("column %s has type %s, expected type %s", c.name, typ, c.typ))
+		}
+	}
+
+	return diff, nil
+}
+
+// verifySchema verifies the schema of all provided tables. Depending on the
+// verification mode, a warning is logged for each difference or an error with
+// all differences is returned.
+func verifySchema(ctx context.Context, w writer, database string, tables []string, columns []column, mode string, logger *slog.Logger) error {
+	switch mode {
+	case "", SchemaVerifyWarn, SchemaVerifyError:
+	case SchemaVerifyNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid schema verification mode %q: must be %q, %q or %q", mode, SchemaVerifyNone, SchemaVerifyWarn, SchemaVerifyError)
+	}
+
+	var errs []error
+	for _, table := range tables {
+		diff, err := diffSchema(ctx, w, database, table, columns)
+		if err != nil {
+			err = fmt.Errorf("failed to verify schema of table %s.%s: %w", database, table, err)
+			if mode == SchemaVerifyError {
+				return err
+			}
+
+			logger.Warn("Failed to verify schema", slog.Any("error", err))
+			continue
+		}
+
+		for _, d := range diff {
+			if mode == SchemaVerifyError {
+				errs = append(errs, fmt.Errorf("table %s.%s: %s", database, table, d))
+				continue
+			}
+
+			logger.Warn("Schema mismatch", slog.String("database", database), slog.String("table", table), slog.String("diff", d))
+		}
+	}
+
+	return errors.Join(errs...)
+}
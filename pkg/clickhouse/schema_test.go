@@ -0,0 +1,168 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaQueries(t *testing.T) {
+	t.Run("should create merge tree table without cluster", func(t *testing.T) {
+		queries := schemaQueries("logs", "logs", rowColumns, SchemaOptions{})
+		require.Len(t, queries, 2)
+		require.Equal(t, "CREATE DATABASE IF NOT EXISTS `logs`", queries[0])
+		require.Contains(t, queries[1], "CREATE TABLE IF NOT EXISTS `logs`.`logs`\n(")
+		require.Contains(t, queries[1], "ENGINE = MergeTree\nPARTITION BY toDate(timestamp)\nORDER BY (cluster, namespace, app, pod_name, container_name, host, timestamp)")
+		require.NotContains(t, queries[1], "TTL")
+	})
+
+	t.Run("should create replicated and distributed table with cluster", func(t *testing.T) {
+		queries := schemaQueries("logs", "audit_logs", rowColumns, SchemaOptions{
+			Cluster:     "{cluster}",
+			TTL:         "toDateTime(timestamp) + INTERVAL 30 DAY",
+			PartitionBy: "toStartOfHour(timestamp)",
+			OrderBy:     "(namespace, timestamp)",
+		})
+		require.Len(t, queries, 3)
+		require.Equal(t, "CREATE DATABASE IF NOT EXISTS `logs` ON CLUSTER `{cluster}`", queries[0])
+		require.Contains(t, queries[1], "CREATE TABLE IF NOT EXISTS `logs`.`audit_logs_local` ON CLUSTER `{cluster}`\n(")
+		require.Contains(t, queries[1], "ENGINE = ReplicatedMergeTree\nPARTITION BY toStartOfHour(timestamp)\nORDER BY (namespace, timestamp)\nTTL toDateTime(timestamp) + INTERVAL 30 DAY")
+		require.Equal(t, "CREATE TABLE IF NOT EXISTS `logs`.`audit_logs` ON CLUSTER `{cluster}` AS `logs`.`audit_logs_local`\nENGINE = Distributed('{cluster}', 'logs', 'audit_logs_local', rand())", queries[2])
+	})
+}
+
+func TestCreateSchema(t *testing.T) {
+	existingTables := func(tables ...string) func(query string, args ...any) ([][]any, error) {
+		return func(query string, args ...any) ([][]any, error) {
+			for _, table := range tables {
+				if args[1] == table {
+					return [][]any{{uint64(1)}}, nil
+				}
+			}
+			return [][]any{{uint64(0)}}, nil
+		}
+	}
+
+	t.Run("should create missing tables", func(t *testing.T) {
+		w := &fakeWriter{queryFn: existingTables("logs")}
+		require.NoError(t, createSchema(context.Background(), w, "logs", []string{"logs", "audit_logs"}, rowColumns, SchemaOptions{Cluster: "default"}, slog.Default()))
+		require.Equal(t, schemaQueries("logs", "audit_logs", rowColumns, SchemaOptions{Cluster: "default"}), w.executed)
+	})
+
+	t.Run("should ignore concurrently created tables", func(t *testing.T) {
+		w := &fakeWriter{
+			queryFn:  existingTables(),
+			execErrs: []error{&clickhouse.Exception{Code: errCodeDatabaseAlreadyExists}, &clickhouse.Exception{Code: errCodeReplicaAlreadyExists}, fmt.Errorf("wrapped: %w", &clickhouse.Exception{Code: errCodeTableAlreadyExists})},
+		}
+		require.NoError(t, createSchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaOptions{Cluster: "default"}, slog.Default()))
+		require.Len(t, w.executed, 3)
+	})
+
+	t.Run("should fail for other errors", func(t *testing.T) {
+		w := &fakeWriter{
+			queryFn:  existingTables(),
+			execErrs: []error{nil, &clickhouse.Exception{Code: 62, Message: "Syntax error"}},
+		}
+		require.Error(t, createSchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaOptions{Cluster: "default"}, slog.Default()))
+		require.Len(t, w.executed, 2)
+	})
+
+	t.Run("should fail when table can not be checked", func(t *testing.T) {
+		w := &fakeWriter{queryFn: func(query string, args ...any) ([][]any, error) {
+			return nil, fmt.Errorf("connection refused")
+		}}
+		require.Error(t, createSchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaOptions{}, slog.Default()))
+		require.Empty(t, w.executed)
+	})
+}
+
+func TestNormalizeType(t *testing.T) {
+	for _, tc := range []struct {
+		typ      string
+		expected string
+	}{
+		{typ: "String", expected: "String"},
+		{typ: "LowCardinality(String)", expected: "String"},
+		{typ: "LowCardinality(Nullable(String))", expected: "String"},
+		{typ: "Map(LowCardinality(String), Float64)", expected: "Map(String, Float64)"},
+		{typ: "Map(LowCardinality(String), Int64)", expected: "Map(String, Int64)"},
+		{typ: "DateTime64(9, 'UTC')", expected: "DateTime"},
+		{typ: "DateTime", expected: "DateTime"},
+		{typ: "JSON", expected: "JSON"},
+		{typ: "JSON(max_dynamic_paths = 1024)", expected: "JSON"},
+	} {
+		t.Run("should normalize "+tc.typ, func(t *testing.T) {
+			require.Equal(t, tc.expected, normalizeType(tc.typ))
+		})
+	}
+}
+
+func TestValidateStorageLayout(t *testing.T) {
+	require.NoError(t, validateStorageLayout("", FieldsOptions{Bool: true, Array: true}))
+	require.NoError(t, validateStorageLayout(StorageLayoutClassic, FieldsOptions{Bool: true}))
+	require.NoError(t, validateStorageLayout(StorageLayoutJSON, FieldsOptions{}))
+	require.Error(t, validateStorageLayout(StorageLayoutJSON, FieldsOptions{Array: true}))
+	require.Error(t, validateStorageLayout("invalid", FieldsOptions{}))
+}
+
+func TestVerifySchema(t *testing.T) {
+	systemColumns := func(tables map[string][][]any) func(query string, args ...any) ([][]any, error) {
+		return func(query string, args ...any) ([][]any, error) {
+			return tables[args[1].(string)], nil
+		}
+	}
+
+	validColumns := func() [][]any {
+		var values [][]any
+		for _, c := range rowColumns {
+			values = append(values, []any{c.name, c.typ})
+		}
+		return append(values, []any{"content_level", "String"})
+	}
+
+	t.Run("should succeed for valid schema", func(t *testing.T) {
+		w := &fakeWriter{queryFn: systemColumns(map[string][][]any{"logs": validColumns()})}
+		require.NoError(t, verifySchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaVerifyError, slog.Default()))
+	})
+
+	t.Run("should return diff for invalid schema", func(t *testing.T) {
+		w := &fakeWriter{queryFn: systemColumns(map[string][][]any{"logs": {
+			{"timestamp", "DateTime64(3)"},
+			{"cluster", "LowCardinality(String)"},
+			{"namespace", "LowCardinality(String)"},
+			{"app", "LowCardinality(String)"},
+			{"pod_name", "LowCardinality(String)"},
+			{"container_name", "LowCardinality(String)"},
+			{"fields_string", "Map(LowCardinality(String), String)"},
+			{"fields_number", "Map(LowCardinality(String), Int64)"},
+			{"log", "String"},
+		}})}
+
+		err := verifySchema(context.Background(), w, "logs", []string{"logs", "audit_logs"}, rowColumns, SchemaVerifyError, slog.Default())
+		require.EqualError(t, err, "table logs.logs: column host is missing, expected type LowCardinality(String)\ntable logs.logs: column fields_number has type Map(LowCardinality(String), Int64), expected type Map(LowCardinality(String), Float64)\ntable logs.audit_logs: table logs.audit_logs does not exist")
+	})
+
+	t.Run("should only warn in warn mode", func(t *testing.T) {
+		w := &fakeWriter{queryFn: systemColumns(map[string][][]any{})}
+		require.NoError(t, verifySchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaVerifyWarn, slog.Default()))
+
+		w = &fakeWriter{queryFn: func(query string, args ...any) ([][]any, error) {
+			return nil, fmt.Errorf("access denied")
+		}}
+		require.NoError(t, verifySchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaVerifyWarn, slog.Default()))
+		require.Error(t, verifySchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaVerifyError, slog.Default()))
+	})
+
+	t.Run("should skip verification in none mode", func(t *testing.T) {
+		w := &fakeWriter{queryFn: systemColumns(map[string][][]any{})}
+		require.NoError(t, verifySchema(context.Background(), w, "logs", []string{"logs"}, rowColumns, SchemaVerifyNone, slog.Default()))
+	})
+
+	t.Run("should fail for invalid mode", func(t *testing.T) {
+		require.Error(t, verifySchema(context.Background(), &fakeWriter{}, "logs", []string{"logs"}, rowColumns, "invalid", slog.Default()))
+	})
+}
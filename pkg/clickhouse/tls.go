@@ -0,0 +1,202 @@
+package clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions contains the options to connect to ClickHouse via TLS. If a
+// client certificate and key are provided, they are used for mutual TLS.
+type TLSOptions struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// reloadingFiles loads the CA and the client certificate from the configured
+// files and reloads them when one of the files was modified, so that rotated
+// certificates are used without restarting Fluent Bit.
+type reloadingFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	caModTime   time.Time
+	pool        *x509.CertPool
+	certModTime time.Time
+	keyModTime  time.Time
+	certificate *tls.Certificate
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// getPool returns the certificate pool with the CAs from the CA file. The file
+// is only read again, when it was modified since the last call.
+func (r *reloadingFiles) getPool() (*x509.CertPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	caModTime, err := modTime(r.caFile)
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+
+	if r.pool != nil && caModTime.Equal(r.caModTime) {
+		return r.pool, nil
+	}
+
+	ca, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, fmt.Errorf("failed to parse CA file %s", r.caFile)
+	}
+
+	r.pool = pool
+	r.caModTime = caModTime
+
+	return r.pool, nil
+}
+
+// getCertificate returns the client certificate from the certificate and key
+// files. The files are only read again, when one of them was modified since the
+// last call. If the files can not be loaded, but a certificate was loaded
+// before, the old certificate is returned, because the files might be in the
+// middle of an update.
+func (r *reloadingFiles) getCertificate() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	certModTime, certErr := modTime(r.certFile)
+	keyModTime, keyErr := modTime(r.keyFile)
+	if certErr != nil || keyErr != nil {
+		if r.certificate != nil {
+			return r.certificate, nil
+		}
+		return nil, fmt.Errorf("failed to read certificate or key file: %w", errors.Join(certErr, keyErr))
+	}
+
+	if r.certificate != nil && certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.certificate != nil {
+			return r.certificate, nil
+		}
+		return nil, err
+	}
+
+	r.certificate = &certificate
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+
+	return r.certificate, nil
+}
+
+// newTLSConfig returns the TLS configuration for the provided options. If TLS
+// is not enabled, nil is returned.
+//
+// When a CA file is provided, the server certificate is verified against the
+// CAs from the file in the VerifyConnection function instead of using the
+// RootCAs field, so that the CAs can be reloaded without creating a new
+// connection pool.
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	if !options.Enabled {
+		return nil, nil
+	}
+
+	files := &reloadingFiles{
+		caFile:   options.CAFile,
+		certFile: options.CertFile,
+		keyFile:  options.KeyFile,
+	}
+
+	// #nosec G402
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		if _, err := files.getCertificate(); err != nil {
+			return nil, err
+		}
+
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.getCertificate()
+		}
+	}
+
+	if options.CAFile != "" && !options.InsecureSkipVerify {
+		if _, err := files.getPool(); err != nil {
+			return nil, err
+		}
+
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			pool, err := files.getPool()
+			if err != nil {
+				return err
+			}
+
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server did not provide a certificate")
+			}
+
+			// The server name is empty, when ClickHouse is reached via an IP
+			// address, because no SNI is sent in this case. Our dial function
+			// sets it to the host of the address, but for connections via a
+			// HTTP proxy the server name must be configured explicitly,
+			// because we do not skip the hostname verification.
+			serverName := options.ServerName
+			if serverName == "" {
+				serverName = cs.ServerName
+			}
+			if serverName == "" {
+				return fmt.Errorf("server name is required to verify the server certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         pool,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	}
+
+	return config, nil
+}
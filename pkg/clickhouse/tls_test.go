@@ -0,0 +1,187 @@
+package clickhouse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate creates a new certificate for the provided common name.
+// If the common name is an IP address, it is added as IP address instead of
+// DNS name to the certificate. If the parent is nil, a self-signed CA
+// certificate is created.
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{commonName}
+	}
+
+	parentCert, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = template.KeyUsage | x509.KeyUsageCertSign
+	} else {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	require.NoError(t, os.WriteFile(file, data, 0600))
+	require.NoError(t, os.Chtimes(file, modTime, modTime))
+}
+
+// handshake runs a TLS handshake between a server using the provided
+// certificate and a client using the provided configuration.
+func handshake(t *testing.T, serverCert *testCertificate, clientConfig *tls.Config) error {
+	serverTLSCert, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverTLSCert}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return tls.Client(conn, clientConfig).Handshake()
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Run("should return nil when disabled", func(t *testing.T) {
+		config, err := newTLSConfig(TLSOptions{})
+		require.NoError(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("should fail for missing files", func(t *testing.T) {
+		_, err := newTLSConfig(TLSOptions{Enabled: true, CAFile: "/does/not/exist"})
+		require.Error(t, err)
+
+		_, err = newTLSConfig(TLSOptions{Enabled: true, CertFile: "/does/not/exist", KeyFile: "/does/not/exist"})
+		require.Error(t, err)
+	})
+
+	t.Run("should verify server certificate with CA file", func(t *testing.T) {
+		dir := t.TempDir()
+		ca := newTestCertificate(t, "ca", nil)
+		server := newTestCertificate(t, "clickhouse", ca)
+		writeFile(t, filepath.Join(dir, "ca.pem"), ca.certPEM, time.Now())
+
+		config, err := newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem"), ServerName: "clickhouse"})
+		require.NoError(t, err)
+		require.NoError(t, handshake(t, server, config))
+
+		config, err = newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem"), ServerName: "other"})
+		require.NoError(t, err)
+		require.Error(t, handshake(t, server, config))
+
+		otherCA := newTestCertificate(t, "ca", nil)
+		config, err = newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem"), ServerName: "clickhouse"})
+		require.NoError(t, err)
+		require.Error(t, handshake(t, newTestCertificate(t, "clickhouse", otherCA), config))
+	})
+
+	t.Run("should reload CA file", func(t *testing.T) {
+		dir := t.TempDir()
+		ca1 := newTestCertificate(t, "ca", nil)
+		ca2 := newTestCertificate(t, "ca", nil)
+		writeFile(t, filepath.Join(dir, "ca.pem"), ca1.certPEM, time.Now().Add(-time.Minute))
+
+		config, err := newTLSConfig(TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "ca.pem"), ServerName: "clickhouse"})
+		require.NoError(t, err)
+		require.Error(t, handshake(t, newTestCertificate(t, "clickhouse", ca2), config))
+
+		writeFile(t, filepath.Join(dir, "ca.pem"), ca2.certPEM, time.Now())
+		require.NoError(t, handshake(t, newTestCertificate(t, "clickhouse", ca2), config))
+	})
+
+	t.Run("should reload client certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		ca := newTestCertificate(t, "ca", nil)
+		client1 := newTestCertificate(t, "client1", ca)
+		client2 := newTestCertificate(t, "client2", ca)
+		writeFile(t, filepath.Join(dir, "tls.crt"), client1.certPEM, time.Now().Add(-time.Minute))
+		writeFile(t, filepath.Join(dir, "tls.key"), client1.keyPEM, time.Now().Add(-time.Minute))
+
+		config, err := newTLSConfig(TLSOptions{Enabled: true, CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")})
+		require.NoError(t, err)
+
+		cert, err := config.GetClientCertificate(nil)
+		require.NoError(t, err)
+		require.Equal(t, client1.cert.Raw, cert.Certificate[0])
+
+		writeFile(t, filepath.Join(dir, "tls.crt"), client2.certPEM, time.Now())
+		writeFile(t, filepath.Join(dir, "tls.key"), client2.keyPEM, time.Now())
+
+		cert, err = config.GetClientCertificate(nil)
+		require.NoError(t, err)
+		require.Equal(t, client2.cert.Raw, cert.Certificate[0])
+
+		require.NoError(t, os.Remove(filepath.Join(dir, "tls.crt")))
+		cert, err = config.GetClientCertificate(nil)
+		require.NoError(t, err)
+		require.Equal(t, client2.cert.Raw, cert.Certificate[0])
+	})
+}
@@ -0,0 +1,251 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	// InsertModeBatch uses the native batch API of clickhouse-go to write the
+	// rows to ClickHouse. This is the default insert mode.
+	InsertModeBatch = "batch"
+	// InsertModeSQL uses the database/sql interface of clickhouse-go to write
+	// the rows to ClickHouse, by executing a prepared statement for each row.
+	InsertModeSQL = "sql"
+)
+
+// writer is the interface which must be implemented by all write paths of the
+// client. A writer writes a list of rows to a table in the provided database.
+// The exec and query methods are used to create and verify the schema.
+type writer interface {
+	write(ctx context.Context, database, table string, rows []Row) error
+	exec(ctx context.Context, query string) error
+	query(ctx context.Context, query string, args ...any) (rows, error)
+	ping(ctx context.Context) error
+	close() error
+}
+
+// rows is the result of a query. It is implemented by the rows of the native
+// and the database/sql interface of clickhouse-go.
+type rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// insertQuery returns the INSERT statement for the provided database and
+// table. The enabled fields columns and the configured dedicated columns are
+// added after the columns of a row for the storage layout. The database, table
+// and column names must be validated before.
+func insertQuery(database, table, storageLayout string, fields FieldsOptions, columns []Column) string {
+	var names string
+	for i, c := range layoutColumns(storageLayout) {
+		if i > 0 {
+			names = names + ", "
+		}
+		names = names + c.name
+	}
+	for _, c := range fieldsColumns(fields) {
+		names = names + ", " + c.name
+	}
+	for _, c := range columns {
+		names = names + ", " + quoteIdentifier(c.Name)
+	}
+
+	// #nosec G201
+	return fmt.Sprintf("INSERT INTO %s.%s (%s)", quoteIdentifier(database), quoteIdentifier(table), names)
+}
+
+// insertValues returns the values of the provided row in the order of the
+// columns in the INSERT statement.
+func insertValues(row Row, storageLayout string, fields FieldsOptions) []any {
+	if storageLayout == StorageLayoutJSON {
+		return append([]any{row.Timestamp, row.Cluster, row.Namespace, row.App, row.Pod, row.Container, row.Host, row.Fields, row.Log}, row.Columns...)
+	}
+
+	values := []any{row.Timestamp, row.Cluster, row.Namespace, row.App, row.Pod, row.Container, row.Host, row.FieldsString, row.FieldsNumber, row.Log}
+	if fields.Bool {
+		values = append(values, row.FieldsBool)
+	}
+	if fields.Array {
+		values = append(values, row.FieldsArray)
+	}
+
+	return append(values, row.Columns...)
+}
+
+// insertSettings returns the settings, which should be used for the INSERT
+// statements of the batch writer.
+func insertSettings(asyncInsert, waitForAsyncInsert bool) clickhouse.Settings {
+	if !asyncInsert {
+		return nil
+	}
+
+	if waitForAsyncInsert {
+		return clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 1}
+	}
+
+	return clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 0}
+}
+
+// insertSettingsClause returns the SETTINGS clause, which should be added to
+// the INSERT statements of the sql writer.
+func insertSettingsClause(asyncInsert, waitForAsyncInsert bool) string {
+	if !asyncInsert {
+		return ""
+	}
+
+	if waitForAsyncInsert {
+		return " SETTINGS async_insert = 1, wait_for_async_insert = 1"
+	}
+
+	return " SETTINGS async_insert = 1, wait_for_async_insert = 0"
+}
+
+// batchWriter writes rows via the native batch API of clickhouse-go. The rows
+// are appended to a batch, which is then send to ClickHouse in the native
+// columnar format.
+type batchWriter struct {
+	conn          driver.Conn
+	settings      clickhouse.Settings
+	storageLayout string
+	fields        FieldsOptions
+	columns       []Column
+	logger        *slog.Logger
+}
+
+func (w *batchWriter) write(ctx context.Context, database, table string, rows []Row) error {
+	if w.settings != nil {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(w.settings))
+	}
+
+	batch, err := w.conn.PrepareBatch(ctx, insertQuery(database, table, w.storageLayout, w.fields, w.columns))
+	if err != nil {
+		w.logger.Error("Prepare batch failure", slog.Any("error", err))
+		return err
+	}
+
+	defer batch.Abort()
+
+	for _, l := range rows {
+		err = batch.Append(insertValues(l, w.storageLayout, w.fields)...)
+		if err != nil {
+			w.logger.Error("Batch append failure", slog.Any("error", err))
+			return err
+		}
+	}
+
+	if err = batch.Send(); err != nil {
+		w.logger.Error("Batch send failure", slog.Any("error", err))
+		return err
+	}
+
+	return nil
+}
+
+func (w *batchWriter) exec(ctx context.Context, query string) error {
+	return w.conn.Exec(ctx, query)
+}
+
+func (w *batchWriter) query(ctx context.Context, query string, args ...any) (rows, error) {
+	return w.conn.Query(ctx, query, args...)
+}
+
+func (w *batchWriter) ping(ctx context.Context) error {
+	return w.conn.Ping(ctx)
+}
+
+func (w *batchWriter) close() error {
+	return w.conn.Close()
+}
+
+// sqlWriter writes rows via the database/sql interface of clickhouse-go. For
+// each batch a transaction is started and the rows are written via a prepared
+// statement.
+type sqlWriter struct {
+	db            *sql.DB
+	settings      string
+	storageLayout string
+	fields        FieldsOptions
+	columns       []Column
+	logger        *slog.Logger
+}
+
+func (w *sqlWriter) write(ctx context.Context, database, table string, rows []Row) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		w.logger.Error("Begin transaction failure", slog.Any("error", err))
+		return err
+	}
+
+	defer tx.Rollback()
+
+	placeholders := "?" + strings.Repeat(", ?", len(layoutColumns(w.storageLayout))+len(fieldsColumns(w.fields))+len(w.columns)-1)
+	stmt, err := tx.PrepareContext(ctx, insertQuery(database, table, w.storageLayout, w.fields, w.columns)+" VALUES ("+placeholders+")"+w.settings)
+	if err != nil {
+		w.logger.Error("Prepare statement failure", slog.Any("error", err))
+		return err
+	}
+
+	for _, l := range rows {
+		_, err = stmt.ExecContext(ctx, insertValues(l, w.storageLayout, w.fields)...)
+
+		if err != nil {
+			w.logger.Error("Statement exec failure", slog.Any("error", err))
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		w.logger.Error("Commit failure", slog.Any("error", err))
+		return err
+	}
+
+	return nil
+}
+
+func (w *sqlWriter) exec(ctx context.Context, query string) error {
+	_, err := w.db.ExecContext(ctx, query)
+	return err
+}
+
+func (w *sqlWriter) query(ctx context.Context, query string, args ...any) (rows, error) {
+	return w.db.QueryContext(ctx, query, args...)
+}
+
+func (w *sqlWriter) ping(ctx context.Context) error {
+	return w.db.PingContext(ctx)
+}
+
+func (w *sqlWriter) close() error {
+	return w.db.Close()
+}
+
+// newWriter returns the writer for the provided insert mode.
+func newWriter(insertMode string, options *clickhouse.Options, asyncInsert, waitForAsyncInsert bool, storageLayout string, fields FieldsOptions, columns []Column, logger *slog.Logger) (writer, error) {
+	switch insertMode {
+	case InsertModeSQL:
+		db := clickhouse.OpenDB(options)
+		db.SetMaxIdleConns(options.MaxIdleConns)
+		db.SetMaxOpenConns(options.MaxOpenConns)
+		db.SetConnMaxLifetime(options.ConnMaxLifetime)
+
+		return &sqlWriter{db: db, settings: insertSettingsClause(asyncInsert, waitForAsyncInsert), storageLayout: storageLayout, fields: fields, columns: columns, logger: logger}, nil
+	case InsertModeBatch, "":
+		conn, err := clickhouse.Open(options)
+		if err != nil {
+			return nil, err
+		}
+
+		return &batchWriter{conn: conn, settings: insertSettings(asyncInsert, waitForAsyncInsert), storageLayout: storageLayout, fields: fields, columns: columns, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("invalid insert mode %q: must be %q or %q", insertMode, InsertModeBatch, InsertModeSQL)
+	}
+}
@@ -0,0 +1,107 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkRows returns a list of synthetic rows, which can be used to compare
+// the different writers.
+func benchmarkRows(count, fields int) []Row {
+	rows := make([]Row, 0, count)
+
+	for i := 0; i < count; i++ {
+		row := Row{
+			Timestamp:    time.Now(),
+			Cluster:      "benchmark",
+			Namespace:    "default",
+			App:          "app",
+			Pod:          fmt.Sprintf("app-%d", i%10),
+			Container:    "app",
+			Host:         "node",
+			FieldsString: make(map[string]string, fields),
+			FieldsNumber: make(map[string]float64, fields),
+			Log:          strings.Repeat("x", 256),
+		}
+
+		for j := 0; j < fields; j++ {
+			row.FieldsString[fmt.Sprintf("content_string_%d", j)] = fmt.Sprintf("value-%d-%d", i, j)
+			row.FieldsNumber[fmt.Sprintf("content_number_%d", j)] = float64(i * j)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// BenchmarkWriter compares the batch and the sql writer. The benchmark requires
+// a running ClickHouse instance, which must be provided via the
+// "KLOGS_BENCHMARK_ADDRESS" environment variable, e.g.
+// "KLOGS_BENCHMARK_ADDRESS=localhost:9000 go test -run=^$ -bench=BenchmarkWriter ./pkg/clickhouse".
+func BenchmarkWriter(b *testing.B) {
+	address := os.Getenv("KLOGS_BENCHMARK_ADDRESS")
+	if address == "" {
+		b.Skip("KLOGS_BENCHMARK_ADDRESS is not set")
+	}
+
+	options := &clickhouse.Options{
+		Addr:         strings.Split(address, ","),
+		MaxIdleConns: 1,
+		MaxOpenConns: 1,
+	}
+
+	conn, err := clickhouse.Open(options)
+	require.NoError(b, err)
+	defer conn.Close()
+
+	require.NoError(b, conn.Exec(context.Background(), "CREATE DATABASE IF NOT EXISTS klogs_benchmark"))
+	require.NoError(b, conn.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS klogs_benchmark.logs (`timestamp` DateTime64(3), `cluster` LowCardinality(String), `namespace` LowCardinality(String), `app` LowCardinality(String), `pod_name` LowCardinality(String), `container_name` LowCardinality(String), `host` LowCardinality(String), `fields_string` Map(LowCardinality(String), String), `fields_number` Map(LowCardinality(String), Float64), `log` String) ENGINE = MergeTree ORDER BY (cluster, namespace, app, pod_name, container_name, host, timestamp)"))
+	defer conn.Exec(context.Background(), "DROP DATABASE IF EXISTS klogs_benchmark")
+
+	rows := benchmarkRows(10000, 20)
+
+	for _, insertMode := range []string{InsertModeBatch, InsertModeSQL} {
+		b.Run(insertMode, func(b *testing.B) {
+			w, err := newWriter(insertMode, options, false, false, "", FieldsOptions{}, nil, slog.Default())
+			require.NoError(b, err)
+			defer w.close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, w.write(context.Background(), "klogs_benchmark", "logs", rows))
+			}
+		})
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	t.Run("should fail for invalid insert mode", func(t *testing.T) {
+		_, err := newWriter("invalid", &clickhouse.Options{}, false, false, "", FieldsOptions{}, nil, slog.Default())
+		require.Error(t, err)
+	})
+
+	t.Run("should return sql writer", func(t *testing.T) {
+		w, err := newWriter(InsertModeSQL, &clickhouse.Options{Addr: []string{"localhost:9000"}}, true, true, "", FieldsOptions{}, nil, slog.Default())
+		require.NoError(t, err)
+		require.IsType(t, &sqlWriter{}, w)
+		require.Equal(t, " SETTINGS async_insert = 1, wait_for_async_insert = 1", w.(*sqlWriter).settings)
+	})
+
+	t.Run("should return batch writer", func(t *testing.T) {
+		w, err := newWriter(InsertModeBatch, &clickhouse.Options{Addr: []string{"localhost:9000"}}, true, false, "", FieldsOptions{}, nil, slog.Default())
+		require.NoError(t, err)
+		require.IsType(t, &batchWriter{}, w)
+		require.Equal(t, clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 0}, w.(*batchWriter).settings)
+	})
+}
@@ -0,0 +1,181 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// EventTime is the msgpack extension type 0, which is used by Fluent Bit to
+// encode the timestamp of a record with nanosecond precision.
+type EventTime struct {
+	time.Time
+}
+
+// WriteExt encodes the time as 4 byte seconds and 4 byte nanoseconds. It is
+// only used to generate records in tests.
+func (e EventTime) WriteExt(v interface{}) []byte {
+	var t time.Time
+	switch v := v.(type) {
+	case EventTime:
+		t = v.Time
+	case *EventTime:
+		t = v.Time
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b
+}
+
+// ReadExt decodes the 4 byte seconds and 4 byte nanoseconds of the time.
+func (e EventTime) ReadExt(v interface{}, b []byte) {
+	if len(b) != 8 {
+		return
+	}
+
+	out := v.(*EventTime)
+	sec := binary.BigEndian.Uint32(b)
+	nsec := binary.BigEndian.Uint32(b[4:])
+	out.Time = time.Unix(int64(sec), int64(nsec))
+}
+
+// Record is a single record from a chunk of Fluent Bit. The metadata is only
+// set for the event format of Fluent Bit v2.1.0 and newer. If the timestamp of
+// the record has an unsupported type, the timestamp is zero.
+type Record struct {
+	Timestamp time.Time
+	Metadata  map[interface{}]interface{}
+	Fields    map[interface{}]interface{}
+}
+
+// Decoder decodes the records from a msgpack encoded chunk of Fluent Bit.
+//
+// In contrast to the decoder of the fluent-bit-go package, the decoder keeps
+// the metadata of a record, which was added in Fluent Bit v2.1.0. The event
+// format of Fluent Bit v2.1.0 is represented as 2-element array with a nested
+// array as the first element, which contains the timestamp and the metadata:
+// [[TIMESTAMP, METADATA], MESSAGE]. The old format [TIMESTAMP, MESSAGE] is also
+// supported.
+//
+// See: https://docs.fluentbit.io/manual/concepts/key-concepts#event-format
+type Decoder struct {
+	decoder *codec.Decoder
+	length  int
+}
+
+// NewHandle returns the msgpack handle, which is used by the decoder. It can
+// also be used to encode records in tests.
+func NewHandle() *codec.MsgpackHandle {
+	handle := new(codec.MsgpackHandle)
+	handle.WriteExt = true
+	handle.SetBytesExt(reflect.TypeOf(EventTime{}), 0, &EventTime{})
+	return handle
+}
+
+// New returns a new decoder for the provided chunk.
+func New(data []byte) *Decoder {
+	// The capacity of the data is limited to its length, because the decoder
+	// reads beyond the length of the data, when the capacity is larger.
+	return &Decoder{
+		decoder: codec.NewDecoderBytes(data[:len(data):len(data)], NewHandle()),
+		length:  len(data),
+	}
+}
+
+// Next returns the next record of the chunk. When all records were decoded
+// io.EOF is returned.
+func (d *Decoder) Next() (*Record, error) {
+	start := d.decoder.NumBytesRead()
+
+	var event interface{}
+	if err := d.decoder.Decode(&event); err != nil {
+		// The decoder also returns io.EOF, when the data ends in the middle
+		// of a record, so that we have to check if there were remaining bytes
+		// before the record was decoded.
+		if err == io.EOF && start >= d.length {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to decode record: %w", err)
+	}
+
+	eventSlice, ok := event.([]interface{})
+	if !ok || len(eventSlice) != 2 {
+		return nil, fmt.Errorf("invalid record: must be an array with 2 elements")
+	}
+
+	fields, ok := eventSlice[1].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid record: message must be a map")
+	}
+
+	record := &Record{Fields: fields}
+
+	ts := eventSlice[0]
+	if header, ok := ts.([]interface{}); ok {
+		if len(header) < 2 {
+			return nil, fmt.Errorf("invalid record: header must be an array with 2 elements")
+		}
+
+		ts = header[0]
+
+		if metadata, ok := header[1].(map[interface{}]interface{}); ok && len(metadata) > 0 {
+			record.Metadata = metadata
+		}
+	}
+
+	record.Timestamp = getTimestamp(ts)
+
+	return record, nil
+}
+
+func getTimestamp(ts interface{}) time.Time {
+	switch t := ts.(type) {
+	case EventTime:
+		return t.Time
+	case *EventTime:
+		return t.Time
+	case uint64:
+		return time.Unix(int64(t), 0)
+	case int64:
+		return time.Unix(t, 0)
+	case float64:
+		sec := int64(t)
+		return time.Unix(sec, int64((t-float64(sec))*1e9))
+	default:
+		return time.Time{}
+	}
+}
+
+// EncodeBinary replaces all binary values in the provided map with their hex
+// encoded representation. Fluent Bit stores some metadata as binary values,
+// e.g. the trace_id and span_id of OpenTelemetry logs, which are not readable
+// as string.
+func EncodeBinary(m map[interface{}]interface{}) {
+	for k, v := range m {
+		m[k] = encodeBinary(v)
+	}
+}
+
+func encodeBinary(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return hex.EncodeToString(t)
+	case map[interface{}]interface{}:
+		EncodeBinary(t)
+		return t
+	case []interface{}:
+		for i := range t {
+			t[i] = encodeBinary(t[i])
+		}
+		return t
+	default:
+		return v
+	}
+}
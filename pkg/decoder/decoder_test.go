@@ -0,0 +1,134 @@
+package decoder
+
+import (
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+// encode encodes the provided events as msgpack, like Fluent Bit does it for a
+// chunk.
+func encode(t *testing.T, events ...interface{}) []byte {
+	var data []byte
+
+	encoder := codec.NewEncoderBytes(&data, NewHandle())
+	for _, event := range events {
+		require.NoError(t, encoder.Encode(event))
+	}
+
+	return data
+}
+
+func TestNext(t *testing.T) {
+	timestamp := time.Unix(1700000000, 123456789)
+
+	t.Run("should decode v1 events", func(t *testing.T) {
+		data := encode(t,
+			[]interface{}{EventTime{timestamp}, map[string]interface{}{"log": "hello world"}},
+			[]interface{}{uint64(1700000000), map[string]interface{}{"log": "hello again"}},
+		)
+
+		d := New(data)
+
+		record, err := d.Next()
+		require.NoError(t, err)
+		require.True(t, timestamp.Equal(record.Timestamp))
+		require.Nil(t, record.Metadata)
+		require.Equal(t, map[interface{}]interface{}{"log": "hello world"}, record.Fields)
+
+		record, err = d.Next()
+		require.NoError(t, err)
+		require.True(t, time.Unix(1700000000, 0).Equal(record.Timestamp))
+		require.Equal(t, map[interface{}]interface{}{"log": "hello again"}, record.Fields)
+
+		_, err = d.Next()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("should decode v2 events with metadata", func(t *testing.T) {
+		traceID := []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}
+		data := encode(t,
+			[]interface{}{
+				[]interface{}{EventTime{timestamp}, map[string]interface{}{
+					"otlp": map[string]interface{}{
+						"trace_id":           traceID,
+						"severity_number":    uint64(9),
+						"resource":           map[string]interface{}{"attributes": map[string]interface{}{"service.name": "checkout"}},
+						"scope":              map[string]interface{}{"name": "io.opentelemetry.checkout", "version": "1.0.0"},
+						"dropped_attr_count": uint64(0),
+					},
+				}},
+				map[string]interface{}{"log": "hello world"},
+			},
+			[]interface{}{
+				[]interface{}{EventTime{timestamp}, map[string]interface{}{}},
+				map[string]interface{}{"log": "without metadata"},
+			},
+		)
+
+		d := New(data)
+
+		record, err := d.Next()
+		require.NoError(t, err)
+		require.True(t, timestamp.Equal(record.Timestamp))
+		require.Equal(t, map[interface{}]interface{}{"log": "hello world"}, record.Fields)
+
+		otlp := record.Metadata["otlp"].(map[interface{}]interface{})
+		require.Equal(t, traceID, otlp["trace_id"])
+		require.Equal(t, int64(9), otlp["severity_number"])
+		require.Equal(t, "checkout", otlp["resource"].(map[interface{}]interface{})["attributes"].(map[interface{}]interface{})["service.name"])
+
+		EncodeBinary(record.Metadata)
+		require.Equal(t, "5b8efff798038103d269b633813fc60c", otlp["trace_id"])
+
+		record, err = d.Next()
+		require.NoError(t, err)
+		require.Nil(t, record.Metadata)
+		require.Equal(t, map[interface{}]interface{}{"log": "without metadata"}, record.Fields)
+
+		_, err = d.Next()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("should decode v2 event from fluent bit", func(t *testing.T) {
+		// [[EventTime(1700000000.5), {"otlp": {"span_id": bin(0102)}}], {"log": "hi"}]
+		data, err := hex.DecodeString("92" + "92" + "d700" + "6553f100" + "1dcd6500" + "81" + "a46f746c70" + "81" + "a77370616e5f6964" + "c4020102" + "81" + "a36c6f67" + "a26869")
+		require.NoError(t, err)
+
+		record, err := New(data).Next()
+		require.NoError(t, err)
+		require.True(t, time.Unix(1700000000, 500000000).Equal(record.Timestamp))
+		require.Equal(t, map[interface{}]interface{}{"log": "hi"}, record.Fields)
+		require.Equal(t, map[interface{}]interface{}{"otlp": map[interface{}]interface{}{"span_id": []byte{0x01, 0x02}}}, record.Metadata)
+	})
+
+	t.Run("should fail for invalid events", func(t *testing.T) {
+		for _, event := range []interface{}{
+			"invalid",
+			[]interface{}{uint64(1700000000)},
+			[]interface{}{uint64(1700000000), "invalid"},
+			[]interface{}{[]interface{}{uint64(1700000000)}, map[string]interface{}{}},
+		} {
+			_, err := New(encode(t, event)).Next()
+			require.Error(t, err)
+			require.NotEqual(t, io.EOF, err)
+		}
+	})
+
+	t.Run("should return zero timestamp for invalid timestamp", func(t *testing.T) {
+		record, err := New(encode(t, []interface{}{"invalid", map[string]interface{}{"log": "hello world"}})).Next()
+		require.NoError(t, err)
+		require.True(t, record.Timestamp.IsZero())
+	})
+
+	t.Run("should fail for truncated data", func(t *testing.T) {
+		data := encode(t, []interface{}{uint64(1700000000), map[string]interface{}{"log": "hello world"}})
+
+		_, err := New(data[:len(data)-3]).Next()
+		require.Error(t, err)
+	})
+}
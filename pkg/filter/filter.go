@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix is the prefix of a pattern, which should be used as regular
+// expression instead of a glob pattern.
+const RegexPrefix = "~"
+
+// Filter decides which flattened keys of a record are written to ClickHouse.
+// If the include list isn't empty, only keys which are matching one of the
+// include patterns are kept. Keys which are matching one of the exclude
+// patterns are always dropped.
+//
+// All patterns of a list are combined into a single regular expression, so
+// that each key only has to be matched once per list.
+type Filter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// Keep returns true, when the provided flattened key should be kept.
+func (f *Filter) Keep(key string) bool {
+	if f.include != nil && !f.include.MatchString(key) {
+		return false
+	}
+
+	if f.exclude != nil && f.exclude.MatchString(key) {
+		return false
+	}
+
+	return true
+}
+
+// Empty returns true, when the filter doesn't contain any patterns, so that all
+// keys are kept.
+func (f *Filter) Empty() bool {
+	return f.include == nil && f.exclude == nil
+}
+
+// compile combines the provided comma separated list of patterns into a single
+// regular expression. A pattern is a glob pattern, where "*" matches any
+// sequence of characters and "?" matches a single character, or a regular
+// expression when it starts with the RegexPrefix. Glob patterns must match the
+// whole key, while regular expressions can match any part of the key.
+func compile(patterns string) (*regexp.Regexp, error) {
+	var expressions []string
+
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if expression, ok := strings.CutPrefix(pattern, RegexPrefix); ok {
+			if _, err := regexp.Compile(expression); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			expressions = append(expressions, "(?:"+expression+")")
+			continue
+		}
+
+		expressions = append(expressions, "(?:^"+globToRegex(pattern)+"$)")
+	}
+
+	if len(expressions) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile(strings.Join(expressions, "|"))
+}
+
+// globToRegex converts the provided glob pattern into a regular expression.
+func globToRegex(pattern string) string {
+	var b strings.Builder
+
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return b.String()
+}
+
+// New returns a new filter for the provided comma separated lists of include
+// and exclude patterns.
+func New(include, exclude string) (*Filter, error) {
+	includeRegex, err := compile(include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include fields: %w", err)
+	}
+
+	excludeRegex, err := compile(exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude fields: %w", err)
+	}
+
+	return &Filter{
+		include: includeRegex,
+		exclude: excludeRegex,
+	}, nil
+}
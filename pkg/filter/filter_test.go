@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should succeed without patterns", func(t *testing.T) {
+		f, err := New("", " , ")
+		require.NoError(t, err)
+		require.True(t, f.Empty())
+		require.True(t, f.Keep("kubernetes_docker_id"))
+	})
+
+	t.Run("should succeed with valid patterns", func(t *testing.T) {
+		f, err := New("kubernetes_*, ~^content_", "kubernetes_annotations_*,kubernetes_docker_id")
+		require.NoError(t, err)
+		require.False(t, f.Empty())
+	})
+
+	for _, tt := range []struct {
+		include string
+		exclude string
+	}{
+		{include: "~content_[", exclude: ""},
+		{include: "", exclude: "~(kubernetes"},
+	} {
+		t.Run("should fail for "+tt.include+tt.exclude, func(t *testing.T) {
+			_, err := New(tt.include, tt.exclude)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestKeep(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		include  string
+		exclude  string
+		key      string
+		expected bool
+	}{
+		{name: "should keep key matching glob include pattern", include: "kubernetes_*", key: "kubernetes_pod_name", expected: true},
+		{name: "should drop key not matching include patterns", include: "kubernetes_*, log", key: "content_level", expected: false},
+		{name: "should match whole key for glob pattern", include: "pod", key: "kubernetes_pod_name", expected: false},
+		{name: "should match single character", exclude: "tags_?", key: "tags_1", expected: false},
+		{name: "should match separator", exclude: "kubernetes.*", key: "kubernetes.labels.app", expected: false},
+		{name: "should quote special characters", exclude: "kubernetes.pod", key: "kubernetes_pod", expected: true},
+		{name: "should match part of key for regex pattern", include: "~pod", key: "kubernetes_pod_name", expected: true},
+		{name: "should drop key matching exclude pattern", exclude: "kubernetes_annotations_*,kubernetes_docker_id", key: "kubernetes_docker_id", expected: false},
+		{name: "should drop key matching regex exclude pattern", exclude: "~^kubernetes_annotations_.+$", key: "kubernetes_annotations_prometheus.io/scrape", expected: false},
+		{name: "should apply exclude after include", include: "kubernetes_*", exclude: "kubernetes_annotations_*", key: "kubernetes_annotations_checksum", expected: false},
+		{name: "should keep key not matching exclude pattern", include: "kubernetes_*", exclude: "kubernetes_annotations_*", key: "kubernetes_labels_app", expected: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.include, tt.exclude)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, f.Keep(tt.key))
+		})
+	}
+}
@@ -1,33 +1,285 @@
 package flatten
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// DefaultSeparator is the separator, which is used to join the keys of nested
+// maps and slices, when no separator is configured.
+const DefaultSeparator = "_"
+
+// OverflowKey is the key in the flat map, which contains all fields above the
+// maximum number of fields as JSON object.
+const OverflowKey = "_overflow"
+
+// The following normalizations can be applied to the keys of a nested map.
+const (
+	NormalizationNone      = "none"
+	NormalizationLowercase = "lowercase"
+	NormalizationSnakeCase = "snake_case"
+)
+
+// Options are the options for flattening a nested map.
+type Options struct {
+	// KeepArrays keeps slices, which only contain scalar values, intact
+	// instead of generating a key for each element of the slice. Slices which
+	// contain maps or other slices are always flattened.
+	KeepArrays bool
+	// Separator is used to join the keys of nested maps and slices. If it is
+	// empty, the DefaultSeparator is used.
+	Separator string
+	// Normalization is applied to each key of a nested map, before the keys
+	// are joined. It must be one of the normalization constants.
+	Normalization string
+	// InvalidCharacters matches all characters in a key of a nested map,
+	// which are replaced by the Replacement. It can be created via the
+	// AllowedCharacters function.
+	InvalidCharacters *regexp.Regexp
+	Replacement       string
+	// MaxKeyLength is the maximum length of a flattened key in bytes. Longer
+	// keys are truncated. If it is 0, the length of the keys isn't limited.
+	MaxKeyLength int
+	// MaxDepth is the maximum number of nested keys in a flattened key. Maps
+	// and slices below the maximum depth are serialized as JSON string. If it
+	// is 0, the depth isn't limited.
+	MaxDepth int
+	// MaxFields is the maximum number of fields in the flat map. All other
+	// fields are serialized as JSON object with their flattened keys and are
+	// added with the OverflowKey, except the KeepKeys. If it is 0, the number
+	// of fields isn't limited.
+	MaxFields int
+	// KeepKeys are the flattened keys, which are always added to the flat map,
+	// even when the maximum number of fields is exceeded, e.g. the keys which
+	// are required for the mapping and the routing of a record.
+	KeepKeys []string
+	// MaxValueLength is the maximum length of a string value in bytes. Longer
+	// values are truncated. If it is 0, the length of the values isn't
+	// limited.
+	MaxValueLength int
+}
+
+// Clipped contains the limits of the options, which were exceeded while a
+// nested map was flattened.
+type Clipped struct {
+	Depth       bool
+	Fields      bool
+	ValueLength bool
+}
+
+// value returns the provided value of a field. If the value is a string which
+// is longer than the maximum value length, the value is truncated.
+func (o Options) value(v interface{}, clipped *Clipped) interface{} {
+	if o.MaxValueLength <= 0 {
+		return v
+	}
+
+	switch t := v.(type) {
+	case string:
+		if len(t) > o.MaxValueLength {
+			clipped.ValueLength = true
+			return truncate(t, o.MaxValueLength)
+		}
+	case []byte:
+		if len(t) > o.MaxValueLength {
+			clipped.ValueLength = true
+			return truncate(string(t), o.MaxValueLength)
+		}
+	}
+
+	return v
+}
+
+// Key returns the flattened key for the provided path of keys in a nested map.
+// The options are applied in the same way as in the Flatten function.
+func (o Options) Key(path ...string) string {
+	var key string
+	for i, subkey := range path {
+		key = o.enkey(i == 0, key, o.normalize(subkey))
+	}
+
+	return o.truncate(key)
+}
+
+func (o Options) separator() string {
+	if o.Separator == "" {
+		return DefaultSeparator
+	}
+	return o.Separator
+}
+
+// normalize applies the normalization and replaces the invalid characters of
+// the provided key of a nested map.
+func (o Options) normalize(key string) string {
+	switch o.Normalization {
+	case NormalizationLowercase:
+		key = strings.ToLower(key)
+	case NormalizationSnakeCase:
+		key = toSnakeCase(key)
+	}
+
+	if o.InvalidCharacters != nil {
+		key = o.InvalidCharacters.ReplaceAllLiteralString(key, o.Replacement)
+	}
+
+	return key
+}
+
+// truncate truncates the provided key to the maximum key length.
+func (o Options) truncate(key string) string {
+	if o.MaxKeyLength <= 0 {
+		return key
+	}
+
+	return truncate(key, o.MaxKeyLength)
+}
+
+// truncate truncates the provided string to the maximum length in bytes. If
+// the string would be truncated in the middle of a multi-byte character, the
+// whole character is removed.
+func truncate(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+
+	n := maxLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// keep returns true, when the provided flattened key must always be added to
+// the flat map.
+func (o Options) keep(key string) bool {
+	for _, k := range o.KeepKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPrefix returns true, when a flattened key, which starts with the provided
+// prefix, can be equal to the provided key after it was truncated.
+func (o Options) hasPrefix(key, prefix string) bool {
+	if o.MaxKeyLength > 0 && len(prefix) >= o.MaxKeyLength {
+		return o.truncate(prefix) == key
+	}
+
+	return strings.HasPrefix(key, prefix)
+}
+
+func (o Options) enkey(top bool, prefix, subkey string) string {
+	if top {
+		return prefix + subkey
+	}
+
+	return prefix + o.separator() + subkey
+}
+
+// AllowedCharacters returns a regular expression, which matches all characters
+// which are not contained in the provided list of allowed characters. The list
+// can contain ranges of characters, e.g. "a-z0-9_".
+func AllowedCharacters(characters string) (*regexp.Regexp, error) {
+	if characters == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("[^" + characters + "]")
+	if err != nil {
+		return nil, fmt.Errorf("invalid characters %q: %w", characters, err)
+	}
+
+	return re, nil
+}
+
+// ValidateNormalization validates the provided normalization.
+func ValidateNormalization(normalization string) error {
+	switch normalization {
+	case NormalizationNone, NormalizationLowercase, NormalizationSnakeCase, "":
+		return nil
+	default:
+		return fmt.Errorf("invalid normalization %q: must be %q, %q or %q", normalization, NormalizationNone, NormalizationLowercase, NormalizationSnakeCase)
+	}
+}
+
 // Flatten generates a flat map from a nested one. The nested map may include
 // values of type map, slice and scalar, but not struct. Keys in the flat map
 // will be a compound of descending map keys and slice iterations.
-func Flatten(nested map[interface{}]interface{}) (map[string]interface{}, error) {
+//
+// The returned Clipped value contains the limits of the options, which were
+// exceeded, so that the caller can report that the map was clipped.
+func Flatten(nested map[interface{}]interface{}, options Options) (map[string]interface{}, Clipped, error) {
 	flatmap := make(map[string]interface{})
+	overflow := make(map[interface{}]interface{})
 
-	err := flatten(true, flatmap, nested, "")
+	var clipped Clipped
+	err := flatten(true, flatmap, overflow, nested, "", 1, options, &clipped)
 	if err != nil {
-		return nil, err
+		return nil, clipped, err
+	}
+
+	if len(overflow) > 0 {
+		flatmap[OverflowKey] = options.value(jsonString(overflow), &clipped)
 	}
 
-	return flatmap, nil
+	return flatmap, clipped, nil
 }
 
-func flatten(top bool, flatMap map[string]interface{}, nested interface{}, prefix string) error {
+func flatten(top bool, flatMap map[string]interface{}, overflow map[interface{}]interface{}, nested interface{}, prefix string, depth int, options Options, clipped *Clipped) error {
+	// set adds the value v with the provided key to the flat map. When the flat
+	// map already contains the maximum number of fields, the value is added to
+	// the overflow instead, except the key must always be kept.
+	set := func(key string, v interface{}, serialize bool) {
+		if options.MaxFields > 0 && len(flatMap) >= options.MaxFields && !options.keep(key) {
+			clipped.Fields = true
+			overflow[key] = v
+			return
+		}
+
+		if serialize {
+			v = jsonString(v)
+		}
+		flatMap[key] = options.value(v, clipped)
+	}
+
 	assign := func(newKey string, v interface{}) error {
-		switch v.(type) {
-		case map[interface{}]interface{}, []interface{}:
-			if err := flatten(false, flatMap, v, newKey); err != nil {
+		switch t := v.(type) {
+		case []interface{}:
+			if options.KeepArrays && isScalarSlice(t) {
+				set(options.truncate(newKey), v, false)
+				return nil
+			}
+
+			if options.MaxDepth > 0 && depth >= options.MaxDepth {
+				clipped.Depth = true
+				set(options.truncate(newKey), v, true)
+				return nil
+			}
+
+			if err := flatten(false, flatMap, overflow, v, newKey, depth+1, options, clipped); err != nil {
+				return err
+			}
+		case map[interface{}]interface{}:
+			if options.MaxDepth > 0 && depth >= options.MaxDepth {
+				clipped.Depth = true
+				set(options.truncate(newKey), v, true)
+				return nil
+			}
+
+			if err := flatten(false, flatMap, overflow, v, newKey, depth+1, options, clipped); err != nil {
 				return err
 			}
 		default:
-			flatMap[newKey] = v
+			set(options.truncate(newKey), v, false)
 		}
 
 		return nil
@@ -36,13 +288,17 @@ func flatten(top bool, flatMap map[string]interface{}, nested interface{}, prefi
 	switch nested := nested.(type) {
 	case map[interface{}]interface{}:
 		for k, v := range nested {
-			newKey := enkey(top, prefix, k.(string))
-			assign(newKey, v)
+			newKey := options.enkey(top, prefix, options.normalize(formatKey(k)))
+			if err := assign(newKey, v); err != nil {
+				return err
+			}
 		}
 	case []interface{}:
 		for i, v := range nested {
-			newKey := enkey(top, prefix, strconv.Itoa(i))
-			assign(newKey, v)
+			newKey := options.enkey(top, prefix, strconv.Itoa(i))
+			if err := assign(newKey, v); err != nil {
+				return err
+			}
 		}
 	default:
 		// Nested input must be a slice or map, for everything else we are
@@ -53,14 +309,146 @@ func flatten(top bool, flatMap map[string]interface{}, nested interface{}, prefi
 	return nil
 }
 
-func enkey(top bool, prefix, subkey string) string {
-	key := prefix
+// Lookup returns the value for the provided flattened key from the nested map,
+// without flattening the whole map. The returned value is the same as the
+// value for the key in the map returned by Flatten, when none of the limits for
+// the depth, the number of fields and the length of values is exceeded.
+func Lookup(nested map[interface{}]interface{}, key string, options Options) (interface{}, bool) {
+	return lookup(true, nested, "", key, options)
+}
 
-	if top {
-		key += subkey
-	} else {
-		key += "_" + subkey
+// lookup returns the value for the provided flattened key from the nested map
+// or slice. The prefix is the flattened key of the nested map or slice. Only
+// the maps and slices which can contain the key are visited.
+func lookup(top bool, nested interface{}, prefix, key string, options Options) (interface{}, bool) {
+	visit := func(newKey string, v interface{}) (interface{}, bool) {
+		switch t := v.(type) {
+		case []interface{}:
+			if options.KeepArrays && isScalarSlice(t) {
+				return v, options.truncate(newKey) == key
+			}
+
+			if options.hasPrefix(key, newKey+options.separator()) {
+				return lookup(false, v, newKey, key, options)
+			}
+		case map[interface{}]interface{}:
+			if options.hasPrefix(key, newKey+options.separator()) {
+				return lookup(false, v, newKey, key, options)
+			}
+		default:
+			return v, options.truncate(newKey) == key
+		}
+
+		return nil, false
 	}
 
-	return key
+	switch nested := nested.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range nested {
+			if value, ok := visit(options.enkey(top, prefix, options.normalize(formatKey(k))), v); ok {
+				return value, true
+			}
+		}
+	case []interface{}:
+		for i, v := range nested {
+			if value, ok := visit(options.enkey(top, prefix, strconv.Itoa(i)), v); ok {
+				return value, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// JSON returns the JSON encoded representation of the provided value. The keys
+// of all maps and binary values are converted to strings, so that a nested map
+// of a record can be encoded.
+func JSON(v interface{}) (string, error) {
+	data, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// jsonString returns the JSON encoded representation of the provided value. If
+// the value can not be encoded, e.g. because it contains a NaN value, the
+// value is formatted via fmt.
+func jsonString(v interface{}) string {
+	s, err := JSON(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return s
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[formatKey(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = jsonValue(e)
+		}
+		return s
+	case []byte:
+		return string(t)
+	default:
+		return v
+	}
+}
+
+// formatKey returns the provided key of a map as string. Besides strings the
+// keys of msgpack maps can be integers or other scalar values, which are
+// formatted via fmt.
+func formatKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+
+	return fmt.Sprintf("%v", k)
+}
+
+// isScalarSlice returns true, when the provided slice doesn't contain any maps
+// or slices.
+func isScalarSlice(s []interface{}) bool {
+	for _, v := range s {
+		switch v.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return false
+		}
+	}
+
+	return true
+}
+
+// toSnakeCase converts the provided key to snake case. An underscore is added
+// before each upper case character, which starts a new word, and spaces,
+// hyphens and dots are replaced by an underscore.
+func toSnakeCase(key string) string {
+	var b strings.Builder
+	b.Grow(len(key) + 4)
+
+	runes := []rune(key)
+	for i, r := range runes {
+		switch {
+		case r == ' ' || r == '-' || r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || (unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
 }
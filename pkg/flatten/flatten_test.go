@@ -0,0 +1,325 @@
+package flatten
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kobsio/klogs/pkg/decoder"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestFlatten(t *testing.T) {
+	nested := map[interface{}]interface{}{
+		"log": "hello world",
+		"content": map[interface{}]interface{}{
+			"level": "info",
+			"tags":  []interface{}{"a", "b"},
+			"items": []interface{}{map[interface{}]interface{}{"id": int64(1)}},
+		},
+	}
+
+	t.Run("should flatten arrays", func(t *testing.T) {
+		flat, _, err := Flatten(nested, Options{})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"log":                "hello world",
+			"content_level":      "info",
+			"content_tags_0":     "a",
+			"content_tags_1":     "b",
+			"content_items_0_id": int64(1),
+		}, flat)
+	})
+
+	t.Run("should keep arrays with scalar values", func(t *testing.T) {
+		flat, _, err := Flatten(nested, Options{KeepArrays: true})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"log":                "hello world",
+			"content_level":      "info",
+			"content_tags":       []interface{}{"a", "b"},
+			"content_items_0_id": int64(1),
+		}, flat)
+	})
+}
+
+func TestLookup(t *testing.T) {
+	nested := map[interface{}]interface{}{
+		"log": "hello world",
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name": "klogs-0",
+			"labels":   map[interface{}]interface{}{"app": "klogs"},
+		},
+		"content": map[interface{}]interface{}{
+			"tags":  []interface{}{"a", "b"},
+			"items": []interface{}{map[interface{}]interface{}{"id": int64(1)}},
+		},
+	}
+
+	invalidCharacters, err := AllowedCharacters("a-z_")
+	require.NoError(t, err)
+
+	for _, options := range []Options{
+		{},
+		{KeepArrays: true},
+		{Separator: ".", Normalization: NormalizationSnakeCase},
+		{Separator: "/", InvalidCharacters: invalidCharacters, Replacement: "x"},
+		{MaxKeyLength: 20},
+		{MaxKeyLength: 17, KeepArrays: true},
+	} {
+		t.Run(fmt.Sprintf("should return same values as flatten for %+v", options), func(t *testing.T) {
+			flat, _, err := Flatten(nested, options)
+			require.NoError(t, err)
+
+			for key, expected := range flat {
+				value, ok := Lookup(nested, key, options)
+				require.True(t, ok, key)
+				require.Equal(t, expected, value, key)
+			}
+		})
+	}
+
+	t.Run("should return false for missing keys", func(t *testing.T) {
+		for _, key := range []string{"message", "kubernetes", "kubernetes_pod", "kubernetes_labels_app_name", "content_tags_2"} {
+			_, ok := Lookup(nested, key, Options{})
+			require.False(t, ok, key)
+		}
+	})
+}
+
+func TestFlattenOptions(t *testing.T) {
+	nested := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"labels": map[interface{}]interface{}{"app.kubernetes.io/name": "klogs"},
+		},
+		"ResponseCode": int64(200),
+		"tags":         []interface{}{"a"},
+	}
+
+	t.Run("should use separator", func(t *testing.T) {
+		flat, _, err := Flatten(nested, Options{Separator: "."})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"kubernetes.labels.app.kubernetes.io/name": "klogs", "ResponseCode": int64(200), "tags.0": "a"}, flat)
+	})
+
+	t.Run("should normalize keys", func(t *testing.T) {
+		flat, _, err := Flatten(nested, Options{Normalization: NormalizationLowercase})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"kubernetes_labels_app.kubernetes.io/name": "klogs", "responsecode": int64(200), "tags_0": "a"}, flat)
+
+		flat, _, err = Flatten(nested, Options{Separator: "/", Normalization: NormalizationSnakeCase})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"kubernetes/labels/app_kubernetes_io/name": "klogs", "response_code": int64(200), "tags/0": "a"}, flat)
+	})
+
+	t.Run("should replace invalid characters", func(t *testing.T) {
+		invalidCharacters, err := AllowedCharacters("a-zA-Z0-9_")
+		require.NoError(t, err)
+
+		flat, _, err := Flatten(nested, Options{Separator: ".", InvalidCharacters: invalidCharacters, Replacement: "_"})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"kubernetes.labels.app_kubernetes_io_name": "klogs", "ResponseCode": int64(200), "tags.0": "a"}, flat)
+	})
+
+	t.Run("should truncate keys", func(t *testing.T) {
+		flat, _, err := Flatten(nested, Options{MaxKeyLength: 10})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"kubernetes": "klogs", "ResponseCo": int64(200), "tags_0": "a"}, flat)
+	})
+
+	t.Run("should not truncate in the middle of a character", func(t *testing.T) {
+		require.Equal(t, "ab", Options{MaxKeyLength: 3}.truncate("abä"))
+	})
+
+	t.Run("should fail for invalid characters", func(t *testing.T) {
+		_, err := AllowedCharacters("z-a")
+		require.Error(t, err)
+	})
+}
+
+func TestKey(t *testing.T) {
+	require.Equal(t, "kubernetes_labels_app", Options{}.Key("kubernetes", "labels", "app"))
+	require.Equal(t, "kubernetes.pod_name", Options{Separator: "."}.Key("kubernetes", "pod_name"))
+	require.Equal(t, "syslog_identifier", Options{Normalization: NormalizationSnakeCase}.Key("SYSLOG_IDENTIFIER"))
+}
+
+func TestToSnakeCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"podName":           "pod_name",
+		"HTTPStatus":        "http_status",
+		"SYSLOG_IDENTIFIER": "syslog_identifier",
+		"_SYSTEMD_UNIT":     "_systemd_unit",
+		"content-type":      "content_type",
+		"service.name":      "service_name",
+		"user id":           "user_id",
+		"status2XX":         "status2_xx",
+	} {
+		require.Equal(t, expected, toSnakeCase(key), key)
+	}
+}
+
+func TestFlattenLimits(t *testing.T) {
+	nested := map[interface{}]interface{}{
+		"log": "hello world",
+		"content": map[interface{}]interface{}{
+			"request": map[interface{}]interface{}{
+				"headers": map[interface{}]interface{}{"accept": "*/*"},
+				"tags":    []interface{}{"a", "b"},
+			},
+		},
+	}
+
+	t.Run("should not clip without limits", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{})
+		require.NoError(t, err)
+		require.Len(t, flat, 4)
+		require.Equal(t, Clipped{}, clipped)
+	})
+
+	t.Run("should serialize maps and slices below max depth", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{MaxDepth: 2})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"log":             "hello world",
+			"content_request": `{"headers":{"accept":"*/*"},"tags":["a","b"]}`,
+		}, flat)
+		require.Equal(t, Clipped{Depth: true}, clipped)
+	})
+
+	t.Run("should serialize fields above max fields", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{MaxFields: 3})
+		require.NoError(t, err)
+		require.Len(t, flat, 4)
+		require.Equal(t, Clipped{Fields: true}, clipped)
+
+		var overflow map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(flat[OverflowKey].(string)), &overflow))
+		require.Len(t, overflow, 1)
+		for key, value := range overflow {
+			require.NotContains(t, flat, key)
+			require.Contains(t, []string{"log", "content_request_headers_accept", "content_request_tags_0", "content_request_tags_1"}, key)
+			require.Contains(t, []interface{}{"hello world", "*/*", "a", "b"}, value)
+		}
+	})
+
+	t.Run("should keep keys above max fields", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{MaxFields: 1, KeepKeys: []string{"log", "content_request_headers_accept"}})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"log":                            "hello world",
+			"content_request_headers_accept": "*/*",
+			OverflowKey:                      `{"content_request_tags_0":"a","content_request_tags_1":"b"}`,
+		}, flat)
+		require.Equal(t, Clipped{Fields: true}, clipped)
+	})
+
+	t.Run("should truncate values above max value length", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{MaxValueLength: 5})
+		require.NoError(t, err)
+		require.Equal(t, "hello", flat["log"])
+		require.Equal(t, "*/*", flat["content_request_headers_accept"])
+		require.Equal(t, Clipped{ValueLength: true}, clipped)
+	})
+
+	t.Run("should truncate serialized values", func(t *testing.T) {
+		flat, clipped, err := Flatten(nested, Options{MaxDepth: 1, MaxValueLength: 10})
+		require.NoError(t, err)
+		require.Equal(t, `{"request"`, flat["content"])
+		require.Equal(t, "hello worl", flat["log"])
+		require.Equal(t, Clipped{Depth: true, ValueLength: true}, clipped)
+	})
+}
+
+func TestJSON(t *testing.T) {
+	s, err := JSON(map[interface{}]interface{}{"a": []interface{}{[]byte("b"), int64(1)}, int64(2): nil})
+	require.NoError(t, err)
+	require.Equal(t, `{"2":null,"a":["b",1]}`, s)
+}
+
+func TestFlattenNonStringKeys(t *testing.T) {
+	nested := map[interface{}]interface{}{
+		int64(1):     map[interface{}]interface{}{uint64(2): "b", true: "c"},
+		float64(1.5): "d",
+		nil:          "e",
+	}
+
+	flat, _, err := Flatten(nested, Options{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"1_2": "b", "1_true": "c", "1.5": "d", "<nil>": "e"}, flat)
+
+	for key, expected := range flat {
+		value, ok := Lookup(nested, key, Options{})
+		require.True(t, ok, key)
+		require.Equal(t, expected, value, key)
+	}
+}
+
+func FuzzFlatten(f *testing.F) {
+	handle := decoder.NewHandle()
+	handle.MaxInitLen = 1024
+
+	for _, seed := range []interface{}{
+		map[string]interface{}{"log": "hello world", "content": map[string]interface{}{"level": "info", "tags": []interface{}{"a", int64(1)}}},
+		[]interface{}{decoder.EventTime{Time: time.Unix(1700000000, 0)}, map[string]interface{}{"log": "hello world"}},
+		[]interface{}{[]interface{}{uint64(1700000000), map[string]interface{}{"otlp": map[string]interface{}{"trace_id": []byte{0x01}}}}, map[string]interface{}{"log": "hello world"}},
+	} {
+		var data []byte
+		require.NoError(f, codec.NewEncoderBytes(&data, handle).Encode(seed))
+		f.Add(data)
+	}
+
+	// {bin("b"): "a"}
+	f.Add([]byte{0x81, 0xc4, 0x01, 0x62, 0xa1, 0x61})
+	// {1: "a", "b": {2: [nil, true, 1.5]}}
+	f.Add([]byte{0x82, 0x01, 0xa1, 0x61, 0xa1, 0x62, 0x81, 0x02, 0x93, 0xc0, 0xc3, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Large inputs are skipped, because each key of the flat map is looked
+		// up in the nested map, which is quadratic in the number of fields.
+		if len(data) > 4096 {
+			return
+		}
+
+		var maps []map[interface{}]interface{}
+
+		var v interface{}
+		if err := codec.NewDecoderBytes(data[:len(data):len(data)], handle).Decode(&v); err == nil {
+			if m, ok := v.(map[interface{}]interface{}); ok {
+				maps = append(maps, m)
+			}
+		}
+
+		d := decoder.New(data)
+		for {
+			record, err := d.Next()
+			if err != nil {
+				break
+			}
+			maps = append(maps, record.Fields, record.Metadata)
+		}
+
+		for _, m := range maps {
+			for _, options := range []Options{
+				{},
+				{KeepArrays: true, Separator: ".", Normalization: NormalizationSnakeCase, MaxKeyLength: 8},
+				{MaxDepth: 2, MaxFields: 4, MaxValueLength: 8},
+			} {
+				flat, _, err := Flatten(m, options)
+				require.NoError(t, err)
+
+				if options.MaxFields > 0 {
+					require.LessOrEqual(t, len(flat), options.MaxFields+1)
+				}
+
+				for key := range flat {
+					Lookup(m, key, options)
+				}
+			}
+
+			_, _ = JSON(m)
+		}
+	})
+}
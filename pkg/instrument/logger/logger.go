@@ -45,10 +45,8 @@ func New(format, level string) *slog.Logger {
 	}
 
 	handler = &CustomHandler{handler}
-	logger := slog.New(handler)
-	slog.SetDefault(logger)
 
-	return logger
+	return slog.New(handler)
 }
 
 // CustomHandler is a custom handler for our logger, which adds the request Id
@@ -70,12 +68,11 @@ func (h *CustomHandler) Handle(ctx context.Context, r slog.Record) error {
 }
 
 func (c *CustomHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return c.clone()
+	return &CustomHandler{c.Handler.WithAttrs(attrs)}
 }
 
-func (c *CustomHandler) clone() *CustomHandler {
-	clone := *c
-	return &clone
+func (c *CustomHandler) WithGroup(name string) slog.Handler {
+	return &CustomHandler{c.Handler.WithGroup(name)}
 }
 
 func AppendCtx(parent context.Context, attrs ...slog.Attr) context.Context {
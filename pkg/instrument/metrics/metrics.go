@@ -20,15 +20,16 @@ type Server interface {
 // server implements the Server interface.
 type server struct {
 	*http.Server
+	logger *slog.Logger
 }
 
 // Start starts serving the metrics server.
 func (s *server) Start() {
-	slog.Info("Metrics server started")
+	s.logger.Info("Metrics server started")
 
 	if err := s.ListenAndServe(); err != nil {
 		if err != http.ErrServerClosed {
-			slog.Error("Metrics server died unexpected", slog.Any("error", err))
+			s.logger.Error("Metrics server died unexpected", slog.Any("error", err))
 		}
 	}
 }
@@ -38,18 +39,19 @@ func (s *server) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	slog.Debug("Start shutdown of the metrics server")
+	s.logger.Debug("Start shutdown of the metrics server")
 
 	err := s.Shutdown(ctx)
 	if err != nil {
-		slog.Error("Graceful shutdown of the metrics server failed", slog.Any("error", err))
+		s.logger.Error("Graceful shutdown of the metrics server failed", slog.Any("error", err))
 	}
 }
 
 // New return a new metrics server, which is used to serve Prometheus metrics on
-// the specified address under the /metrics path.
-func New(address string) Server {
-	router := http.DefaultServeMux
+// the specified address under the /metrics path. The provided logger is used
+// for all logs of the server.
+func New(address string, logger *slog.Logger) Server {
+	router := http.NewServeMux()
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "OK")
 	})
@@ -61,5 +63,6 @@ func New(address string) Server {
 			Handler:           router,
 			ReadHeaderTimeout: 5 * time.Second,
 		},
+		logger,
 	}
 }
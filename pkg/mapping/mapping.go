@@ -0,0 +1,187 @@
+package mapping
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kobsio/klogs/pkg/flatten"
+)
+
+// The following columns of a row can be mapped to the fields of a record.
+const (
+	Cluster   = "cluster"
+	Namespace = "namespace"
+	App       = "app"
+	Pod       = "pod"
+	Container = "container"
+	Host      = "host"
+	Log       = "log"
+)
+
+// Columns is the list of all columns, which can be mapped to the fields of a
+// record.
+var Columns = []string{Cluster, Namespace, App, Pod, Container, Host, Log}
+
+// The following presets can be used as base for a mapping.
+const (
+	PresetKubernetes = "kubernetes"
+	PresetDocker     = "docker"
+	PresetSystemd    = "systemd"
+)
+
+// Presets contains the candidate fields for each column of all presets. A
+// field is defined as path of keys in the nested record, so that the
+// flattened key can be generated for the separator which is used to flatten
+// the record. The candidates are checked in the defined order.
+var Presets = map[string]map[string][][]string{
+	PresetKubernetes: {
+		Cluster:   {{"cluster"}},
+		Namespace: {{"kubernetes", "namespace_name"}},
+		App:       {{"kubernetes", "labels", "app"}, {"kubernetes", "labels", "k8s-app"}},
+		Pod:       {{"kubernetes", "pod_name"}},
+		Container: {{"kubernetes", "container_name"}},
+		Host:      {{"kubernetes", "host"}},
+		Log:       {{"log"}},
+	},
+	PresetDocker: {
+		Cluster:   {{"cluster"}, {"ecs_cluster"}},
+		Namespace: {{"com.docker.compose.project"}, {"ecs_task_definition"}},
+		App:       {{"com.docker.compose.service"}},
+		Pod:       {{"ecs_task_arn"}, {"container_id"}},
+		Container: {{"container_name"}},
+		Host:      {{"hostname"}, {"host"}},
+		Log:       {{"log"}},
+	},
+	PresetSystemd: {
+		Cluster:   {{"cluster"}},
+		Namespace: {{"_SYSTEMD_SLICE"}},
+		App:       {{"SYSLOG_IDENTIFIER"}, {"_COMM"}},
+		Container: {{"_SYSTEMD_UNIT"}},
+		Host:      {{"_HOSTNAME"}, {"hostname"}},
+		Log:       {{"MESSAGE"}, {"log"}},
+	},
+}
+
+// Mapping maps the fields of a flattened record to the columns of a row. For
+// each column an ordered list of candidate fields is defined and the value of
+// the first candidate which is present in a record is used.
+type Mapping struct {
+	candidates map[string][]string
+	keys       map[string]struct{}
+}
+
+// Value returns the value of the first candidate field for the provided column,
+// which is present in the record and isn't nil. If no candidate is present, an
+// empty string is returned.
+func (m *Mapping) Value(column string, fields map[string]interface{}) string {
+	key, ok := m.key(column, fields)
+	if !ok {
+		return ""
+	}
+
+	switch v := fields[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// key returns the first candidate field for the provided column, which is
+// present in the record and isn't nil.
+func (m *Mapping) key(column string, fields map[string]interface{}) (string, bool) {
+	for _, key := range m.candidates[column] {
+		if fieldValue, ok := fields[key]; ok && fieldValue != nil {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// Used returns the candidate fields, which are used for the columns of the
+// provided record. These fields are not added to the fields_string and
+// fields_number maps of a row. All other candidates, e.g. a fallback which
+// wasn't used because a previous candidate was present, are kept.
+func (m *Mapping) Used(fields map[string]interface{}) map[string]struct{} {
+	used := make(map[string]struct{}, len(Columns))
+	for _, column := range Columns {
+		if key, ok := m.key(column, fields); ok {
+			used[key] = struct{}{}
+		}
+	}
+
+	return used
+}
+
+// Keys returns all candidate fields of the mapping.
+func (m *Mapping) Keys() []string {
+	keys := make([]string, 0, len(m.keys))
+	for key := range m.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// New returns a new mapping for the provided preset. The candidates of the
+// preset can be overwritten for each column via a comma separated list of
+// flattened keys. If the preset is empty, the kubernetes preset is used. The
+// flatten options are used to generate the flattened keys of the preset.
+func New(preset string, overrides map[string]string, options flatten.Options) (*Mapping, error) {
+	if preset == "" {
+		preset = PresetKubernetes
+	}
+
+	presetCandidates, ok := Presets[preset]
+	if !ok {
+		return nil, fmt.Errorf("invalid preset %q: must be %q, %q or %q", preset, PresetKubernetes, PresetDocker, PresetSystemd)
+	}
+
+	m := &Mapping{
+		candidates: make(map[string][]string),
+		keys:       make(map[string]struct{}),
+	}
+
+	for _, column := range Columns {
+		for _, path := range presetCandidates[column] {
+			m.candidates[column] = append(m.candidates[column], options.Key(path...))
+		}
+	}
+
+	for column, override := range overrides {
+		if !isColumn(column) {
+			return nil, fmt.Errorf("invalid column %q", column)
+		}
+
+		if strings.TrimSpace(override) == "" {
+			continue
+		}
+
+		var candidates []string
+		for _, key := range strings.Split(override, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				candidates = append(candidates, key)
+			}
+		}
+		m.candidates[column] = candidates
+	}
+
+	for _, candidates := range m.candidates {
+		for _, key := range candidates {
+			m.keys[key] = struct{}{}
+		}
+	}
+
+	return m, nil
+}
+
+func isColumn(column string) bool {
+	for _, c := range Columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package mapping
+
+import (
+	"testing"
+
+	"github.com/kobsio/klogs/pkg/flatten"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should use kubernetes preset by default", func(t *testing.T) {
+		m, err := New("", nil, flatten.Options{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"kubernetes_labels_app", "kubernetes_labels_k8s-app"}, m.candidates[App])
+		require.Contains(t, m.Keys(), "kubernetes_namespace_name")
+		require.NotContains(t, m.Keys(), "kubernetes_labels_team")
+	})
+
+	t.Run("should overwrite candidates of preset", func(t *testing.T) {
+		m, err := New(PresetDocker, map[string]string{Host: "node, hostname", App: ""}, flatten.Options{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"node", "hostname"}, m.candidates[Host])
+		require.Equal(t, []string{"com.docker.compose.service"}, m.candidates[App])
+		require.Contains(t, m.Keys(), "node")
+		require.NotContains(t, m.Keys(), "host")
+	})
+
+	t.Run("should use flatten options for candidates of preset", func(t *testing.T) {
+		m, err := New(PresetSystemd, nil, flatten.Options{Separator: ".", Normalization: flatten.NormalizationSnakeCase})
+		require.NoError(t, err)
+		require.Equal(t, []string{"syslog_identifier", "_comm"}, m.candidates[App])
+
+		m, err = New(PresetKubernetes, nil, flatten.Options{Separator: "/"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"kubernetes/labels/app", "kubernetes/labels/k8s-app"}, m.candidates[App])
+	})
+
+	t.Run("should fail for invalid preset", func(t *testing.T) {
+		_, err := New("ecs", nil, flatten.Options{})
+		require.Error(t, err)
+	})
+
+	t.Run("should fail for invalid column", func(t *testing.T) {
+		_, err := New(PresetKubernetes, map[string]string{"level": "level"}, flatten.Options{})
+		require.Error(t, err)
+	})
+}
+
+func TestValue(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		preset   string
+		fields   map[string]interface{}
+		expected map[string]string
+	}{
+		{
+			name:   "kubernetes",
+			preset: PresetKubernetes,
+			fields: map[string]interface{}{
+				"cluster":                   "dev",
+				"kubernetes_namespace_name": "default",
+				"kubernetes_labels_k8s-app": "kube-dns",
+				"kubernetes_pod_name":       "coredns-0",
+				"kubernetes_container_name": "coredns",
+				"kubernetes_host":           "node1",
+				"log":                       []byte("hello world"),
+			},
+			expected: map[string]string{Cluster: "dev", Namespace: "default", App: "kube-dns", Pod: "coredns-0", Container: "coredns", Host: "node1", Log: "hello world"},
+		},
+		{
+			name:   "kubernetes with app label",
+			preset: PresetKubernetes,
+			fields: map[string]interface{}{
+				"kubernetes_labels_k8s-app": "kube-dns",
+				"kubernetes_labels_app":     "coredns",
+			},
+			expected: map[string]string{Cluster: "", Namespace: "", App: "coredns", Pod: "", Container: "", Host: "", Log: ""},
+		},
+		{
+			name:   "docker compose",
+			preset: PresetDocker,
+			fields: map[string]interface{}{
+				"com.docker.compose.project": "shop",
+				"com.docker.compose.service": "api",
+				"container_id":               "2f1c",
+				"container_name":             "/shop-api-1",
+				"hostname":                   "docker1",
+				"log":                        "hello world",
+			},
+			expected: map[string]string{Cluster: "", Namespace: "shop", App: "api", Pod: "2f1c", Container: "/shop-api-1", Host: "docker1", Log: "hello world"},
+		},
+		{
+			name:   "ecs",
+			preset: PresetDocker,
+			fields: map[string]interface{}{
+				"ecs_cluster":         "prod",
+				"ecs_task_definition": "api:3",
+				"ecs_task_arn":        "arn:aws:ecs:eu-central-1:123456789012:task/prod/1a2b",
+				"container_id":        "2f1c",
+				"host":                nil,
+			},
+			expected: map[string]string{Cluster: "prod", Namespace: "api:3", App: "", Pod: "arn:aws:ecs:eu-central-1:123456789012:task/prod/1a2b", Container: "", Host: "", Log: ""},
+		},
+		{
+			name:   "systemd",
+			preset: PresetSystemd,
+			fields: map[string]interface{}{
+				"_HOSTNAME":         "node1",
+				"_SYSTEMD_UNIT":     "kubelet.service",
+				"_SYSTEMD_SLICE":    "system.slice",
+				"_COMM":             "kubelet",
+				"SYSLOG_IDENTIFIER": "kubelet",
+				"MESSAGE":           "hello world",
+				"PRIORITY":          6,
+			},
+			expected: map[string]string{Cluster: "", Namespace: "system.slice", App: "kubelet", Pod: "", Container: "kubelet.service", Host: "node1", Log: "hello world"},
+		},
+	} {
+		t.Run("should return values for "+tc.name, func(t *testing.T) {
+			m, err := New(tc.preset, nil, flatten.Options{})
+			require.NoError(t, err)
+
+			actual := make(map[string]string)
+			for _, column := range Columns {
+				actual[column] = m.Value(column, tc.fields)
+			}
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestUsed(t *testing.T) {
+	t.Run("should only return used candidates", func(t *testing.T) {
+		m, err := New(PresetDocker, nil, flatten.Options{})
+		require.NoError(t, err)
+		require.Equal(t, map[string]struct{}{"hostname": {}, "container_id": {}, "log": {}}, m.Used(map[string]interface{}{
+			"hostname":     "docker1",
+			"host":         "10.0.0.1",
+			"container_id": "2f1c",
+			"ecs_cluster":  nil,
+			"log":          "hello world",
+			"level":        "info",
+		}))
+	})
+
+	t.Run("should return fallback candidate", func(t *testing.T) {
+		m, err := New(PresetDocker, nil, flatten.Options{})
+		require.NoError(t, err)
+		require.Equal(t, map[string]struct{}{"host": {}}, m.Used(map[string]interface{}{
+			"hostname": nil,
+			"host":     "10.0.0.1",
+		}))
+	})
+}
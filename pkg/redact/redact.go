@@ -0,0 +1,400 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kobsio/klogs/pkg/filter"
+	"github.com/kobsio/klogs/pkg/flatten"
+)
+
+// The following actions can be applied to the values which are matched by a
+// rule.
+const (
+	// ActionMask replaces the matched part of a value with the Mask.
+	ActionMask = "mask"
+	// ActionHash replaces the matched part of a value with the hex encoded
+	// HMAC-SHA256 of the matched part, so that values remain joinable.
+	ActionHash = "hash"
+	// ActionDrop drops the whole value, when a part of it was matched.
+	ActionDrop = "drop"
+)
+
+// The following built-in detectors can be used in a rule. All other detectors
+// must be regular expressions, which are prefixed with the RegexPrefix.
+const (
+	DetectorEmail       = "email"
+	DetectorIPv4        = "ipv4"
+	DetectorIPv6        = "ipv6"
+	DetectorBearerToken = "bearer_token"
+	DetectorCreditCard  = "credit_card"
+)
+
+// RegexPrefix is the prefix of a detector, which is a regular expression.
+const RegexPrefix = "~"
+
+// Mask is the replacement for the matched parts of a value, when the mask
+// action is used.
+const Mask = "[REDACTED]"
+
+// detector finds the parts of a value, which should be redacted. If the regular
+// expression contains a capturing group, only the first group is redacted. The
+// optional valid function is used to discard false positives of the regular
+// expression.
+type detector struct {
+	re    *regexp.Regexp
+	valid func(s string) bool
+}
+
+var detectors = map[string]detector{
+	DetectorEmail: {
+		re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	DetectorIPv4: {
+		re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\b`),
+	},
+	DetectorIPv6: {
+		re:    regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}(?:[0-9a-f]{1,4}|(?:[0-9]{1,3}\.){3}[0-9]{1,3})?`),
+		valid: isIPv6,
+	},
+	DetectorBearerToken: {
+		re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	},
+	DetectorCreditCard: {
+		re:    regexp.MustCompile(`\b(?:[0-9][ \-]?){12,18}[0-9]\b`),
+		valid: isCreditCard,
+	},
+}
+
+// isIPv6 returns true, when the provided string is a valid IPv6 address. The
+// regular expression of the ipv6 detector also matches timestamps and MAC
+// addresses, which are discarded by this check.
+func isIPv6(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	return err == nil && addr.Is6()
+}
+
+// isCreditCard returns true, when the digits of the provided string have the
+// length of a credit card number and a valid Luhn checksum.
+func isCreditCard(s string) bool {
+	var digits []int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	var sum int
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			d = d * 2
+			if d > 9 {
+				d = d - 9
+			}
+		}
+		sum = sum + d
+	}
+
+	return sum%10 == 0
+}
+
+// Rule is a single redaction rule. If the Field is empty the rule is applied to
+// all values, otherwise it is only applied to the values of the flattened keys
+// matching the Field. The Detector is the name of a built-in detector or a
+// regular expression prefixed with the RegexPrefix.
+type Rule struct {
+	Field    string
+	Detector string
+	Action   string
+}
+
+// String returns the rule in the format in which it was defined. It is used as
+// label for the metrics of a rule.
+func (r Rule) String() string {
+	if r.Field == "" {
+		return r.Detector + " => " + r.Action
+	}
+	return r.Field + "=" + r.Detector + " => " + r.Action
+}
+
+type rule struct {
+	Rule
+	field    *filter.Filter
+	detector detector
+}
+
+// Redactor redacts the values of a record, which are matched by the rules. The
+// rules are applied in the order they were defined, so that later rules see
+// the result of former rules.
+type Redactor struct {
+	rules   []rule
+	hashKey []byte
+}
+
+// Rules returns the rules of the redactor. The number of values which were
+// redacted by a rule is returned at the same index in the counts of the Redact
+// and RedactNested methods.
+func (r *Redactor) Rules() []Rule {
+	rules := make([]Rule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		rules = append(rules, rule.Rule)
+	}
+	return rules
+}
+
+// Empty returns true, when the redactor doesn't contain any rules.
+func (r *Redactor) Empty() bool {
+	return len(r.rules) == 0
+}
+
+// Redact applies the rules to the value of the provided flattened key. It
+// returns the redacted value and false when the value was dropped. For each
+// rule which changed the value, the counter at the index of the rule is
+// increased.
+func (r *Redactor) Redact(key, value string, counts []int) (string, bool) {
+	for i, rule := range r.rules {
+		if rule.field != nil && !rule.field.Keep(key) {
+			continue
+		}
+
+		redacted, changed := r.replace(rule, value)
+		if !changed {
+			continue
+		}
+
+		counts[i]++
+		if rule.Action == ActionDrop {
+			return "", false
+		}
+		value = redacted
+	}
+
+	return value, true
+}
+
+// replace replaces all parts of the value, which are found by the detector of
+// the rule, and returns true, when the value was changed.
+func (r *Redactor) replace(rule rule, value string) (string, bool) {
+	matches := rule.detector.re.FindAllStringSubmatchIndex(value, -1)
+	if len(matches) == 0 {
+		return value, false
+	}
+
+	var b strings.Builder
+	var last int
+	var changed bool
+
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) > 2 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+
+		// Empty matches are skipped, so that a regular expression like "a*"
+		// doesn't add a replacement between all characters.
+		if start == end {
+			continue
+		}
+
+		if rule.detector.valid != nil && !rule.detector.valid(value[start:end]) {
+			continue
+		}
+
+		changed = true
+		if rule.Action == ActionDrop {
+			return "", true
+		}
+
+		b.WriteString(value[last:start])
+		if rule.Action == ActionHash {
+			b.WriteString(r.hash(value[start:end]))
+		} else {
+			b.WriteString(Mask)
+		}
+		last = end
+	}
+
+	if !changed {
+		return value, false
+	}
+
+	b.WriteString(value[last:])
+	return b.String(), true
+}
+
+// hash returns the hex encoded HMAC-SHA256 of the provided value.
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RedactNested applies the rules to all values of the provided nested map. The
+// keys of the values are flattened with the provided options, so that the same
+// fields are matched as for a flattened record. Numbers are formatted as
+// string, when they are redacted.
+func (r *Redactor) RedactNested(nested map[interface{}]interface{}, options flatten.Options, counts []int) {
+	r.redactNested(nested, nil, options, counts)
+}
+
+func (r *Redactor) redactNested(nested interface{}, path []string, options flatten.Options, counts []int) (interface{}, bool) {
+	switch t := nested.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range t {
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprintf("%v", k)
+			}
+
+			if value, ok := r.redactNested(v, append(path, key), options, counts); ok {
+				t[k] = value
+			} else {
+				delete(t, k)
+			}
+		}
+		return t, true
+	case []interface{}:
+		s := t[:0]
+		for i, v := range t {
+			if value, ok := r.redactNested(v, append(path, strconv.Itoa(i)), options, counts); ok {
+				s = append(s, value)
+			}
+		}
+		return s, true
+	default:
+		value, ok := scalar(nested)
+		if !ok {
+			return nested, true
+		}
+
+		redacted, ok := r.Redact(options.Key(path...), value, counts)
+		if !ok {
+			return nil, false
+		}
+		if redacted == value {
+			return nested, true
+		}
+		return redacted, true
+	}
+}
+
+// scalar returns the string representation of a string, binary or numeric
+// value. For all other values false is returned, because they can not contain
+// any sensitive data.
+func scalar(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case uint64:
+		return strconv.FormatUint(t, 10), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// parseRule parses a single redaction rule. A rule has the format
+// "<detector> => <action>" to match all values or the format
+// "<field>=<detector> => <action>" to match the values of the flattened keys
+// matching the field glob pattern.
+func parseRule(definition string) (rule, error) {
+	parts := strings.Split(definition, "=>")
+	if len(parts) != 2 {
+		return rule{}, fmt.Errorf("invalid redaction rule %q: must have the format \"<detector> => <action>\" or \"<field>=<detector> => <action>\"", definition)
+	}
+
+	var field string
+	name := strings.TrimSpace(parts[0])
+	action := strings.TrimSpace(parts[1])
+
+	// A regular expression can contain a "=", so that we only look for a field
+	// when the detector isn't a regular expression.
+	if !strings.HasPrefix(name, RegexPrefix) {
+		if before, after, found := strings.Cut(name, "="); found {
+			field = strings.TrimSpace(before)
+			name = strings.TrimSpace(after)
+
+			if field == "" || strings.HasPrefix(field, RegexPrefix) {
+				return rule{}, fmt.Errorf("invalid redaction rule %q: field must be a glob pattern", definition)
+			}
+		}
+	}
+
+	switch action {
+	case ActionMask, ActionHash, ActionDrop:
+	default:
+		return rule{}, fmt.Errorf("invalid redaction rule %q: action must be %q, %q or %q", definition, ActionMask, ActionHash, ActionDrop)
+	}
+
+	r := rule{Rule: Rule{Field: field, Detector: name, Action: action}}
+
+	if expression, ok := strings.CutPrefix(name, RegexPrefix); ok {
+		if expression == "" {
+			return rule{}, fmt.Errorf("invalid redaction rule %q: regular expression is required", definition)
+		}
+
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid redaction rule %q: %w", definition, err)
+		}
+		r.detector = detector{re: re}
+	} else {
+		d, ok := detectors[name]
+		if !ok {
+			return rule{}, fmt.Errorf("invalid redaction rule %q: detector must be %q, %q, %q, %q, %q or a regular expression prefixed with %q", definition, DetectorEmail, DetectorIPv4, DetectorIPv6, DetectorBearerToken, DetectorCreditCard, RegexPrefix)
+		}
+		r.detector = d
+	}
+
+	if field != "" {
+		f, err := filter.New(field, "")
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid redaction rule %q: %w", definition, err)
+		}
+		r.field = f
+	}
+
+	return r, nil
+}
+
+// New returns a new redactor for the provided comma separated list of
+// redaction rules. The hash key is required, when one of the rules uses the
+// hash action.
+func New(rules, hashKey string) (*Redactor, error) {
+	r := &Redactor{hashKey: []byte(hashKey)}
+
+	for _, definition := range strings.Split(rules, ",") {
+		if strings.TrimSpace(definition) == "" {
+			continue
+		}
+
+		rule, err := parseRule(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		if rule.Action == ActionHash && hashKey == "" {
+			return nil, fmt.Errorf("invalid redaction rule %q: hash key is required for the %q action", definition, ActionHash)
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
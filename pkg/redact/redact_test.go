@@ -0,0 +1,123 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/kobsio/klogs/pkg/flatten"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should succeed without rules", func(t *testing.T) {
+		r, err := New("", "")
+		require.NoError(t, err)
+		require.True(t, r.Empty())
+	})
+
+	t.Run("should succeed with valid rules", func(t *testing.T) {
+		r, err := New("email => hash, ipv4 => mask,content_auth=bearer_token => drop, ~password=(\\S+) => mask, content_*=~[0-9]+ => mask", "secret")
+		require.NoError(t, err)
+		require.Equal(t, []Rule{
+			{Detector: "email", Action: "hash"},
+			{Detector: "ipv4", Action: "mask"},
+			{Field: "content_auth", Detector: "bearer_token", Action: "drop"},
+			{Detector: "~password=(\\S+)", Action: "mask"},
+			{Field: "content_*", Detector: "~[0-9]+", Action: "mask"},
+		}, r.Rules())
+		require.Equal(t, "content_auth=bearer_token => drop", r.Rules()[2].String())
+	})
+
+	for _, rules := range []string{"email", "email =>", "=> mask", "=email => mask", "phone => mask", "email => remove", "~ => mask", "~[ => mask", "email => hash"} {
+		t.Run("should fail for "+rules, func(t *testing.T) {
+			_, err := New(rules, "")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		rules         string
+		key           string
+		value         string
+		expectedValue string
+		expectedKeep  bool
+		expectedCount []int
+	}{
+		{name: "should mask email", rules: "email => mask", key: "log", value: "user jane.doe@example.com logged in", expectedValue: "user [REDACTED] logged in", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should drop email", rules: "email => drop", key: "content_user", value: "jane.doe@example.com", expectedValue: "", expectedKeep: false, expectedCount: []int{1}},
+		{name: "should mask multiple ipv4 addresses", rules: "ipv4 => mask", key: "log", value: "10.0.0.1 -> 192.168.1.255", expectedValue: "[REDACTED] -> [REDACTED]", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should not mask invalid ipv4 address", rules: "ipv4 => mask", key: "log", value: "version 1.2.3.456", expectedValue: "version 1.2.3.456", expectedKeep: true, expectedCount: []int{0}},
+		{name: "should mask ipv6 address", rules: "ipv6 => mask", key: "log", value: "client 2001:db8::1 connected", expectedValue: "client [REDACTED] connected", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should not mask time", rules: "ipv6 => mask", key: "log", value: "started at 12:30:45", expectedValue: "started at 12:30:45", expectedKeep: true, expectedCount: []int{0}},
+		{name: "should mask bearer token", rules: "bearer_token => mask", key: "content_headers_authorization", value: "Bearer eyJhbGciOiJIUzI1NiJ9.e30.abc-_=", expectedValue: "Bearer [REDACTED]", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should mask credit card", rules: "credit_card => mask", key: "log", value: "card 4111 1111 1111 1111 charged", expectedValue: "card [REDACTED] charged", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should not mask number with invalid checksum", rules: "credit_card => mask", key: "log", value: "order 4111111111111112", expectedValue: "order 4111111111111112", expectedKeep: true, expectedCount: []int{0}},
+		{name: "should mask group of regex", rules: "~password=(\\S+) => mask", key: "log", value: "login password=hunter2 user=jane", expectedValue: "login password=[REDACTED] user=jane", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should ignore empty matches", rules: "~x* => mask", key: "log", value: "abc", expectedValue: "abc", expectedKeep: true, expectedCount: []int{0}},
+		{name: "should apply rule for matching field", rules: "content_*=ipv4 => mask", key: "content_client", value: "10.0.0.1", expectedValue: "[REDACTED]", expectedKeep: true, expectedCount: []int{1}},
+		{name: "should not apply rule for other field", rules: "content_*=ipv4 => mask", key: "log", value: "10.0.0.1", expectedValue: "10.0.0.1", expectedKeep: true, expectedCount: []int{0}},
+		{name: "should apply rules in order", rules: "email => mask, ~REDACTED => drop", key: "log", value: "jane.doe@example.com", expectedValue: "", expectedKeep: false, expectedCount: []int{1, 1}},
+		{name: "should stop after drop", rules: "email => drop, email => mask", key: "log", value: "jane.doe@example.com", expectedValue: "", expectedKeep: false, expectedCount: []int{1, 0}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.rules, "secret")
+			require.NoError(t, err)
+
+			counts := make([]int, len(r.Rules()))
+			value, keep := r.Redact(tt.key, tt.value, counts)
+			require.Equal(t, tt.expectedKeep, keep)
+			require.Equal(t, tt.expectedCount, counts)
+			require.Equal(t, tt.expectedValue, value)
+		})
+	}
+
+	t.Run("should hash email", func(t *testing.T) {
+		r1, err := New("email => hash", "secret")
+		require.NoError(t, err)
+		r2, err := New("email => hash", "other")
+		require.NoError(t, err)
+
+		counts := make([]int, 1)
+		v1, _ := r1.Redact("log", "user jane.doe@example.com", counts)
+		v2, _ := r1.Redact("content_user", "jane.doe@example.com", counts)
+		v3, _ := r2.Redact("content_user", "jane.doe@example.com", counts)
+		require.Regexp(t, "^user [0-9a-f]{64}$", v1)
+		require.Equal(t, v1, "user "+v2)
+		require.NotEqual(t, v2, v3)
+		require.Equal(t, []int{3}, counts)
+	})
+}
+
+func TestRedactNested(t *testing.T) {
+	r, err := New("ipv4 => mask, content.*=email => drop, credit_card => mask", "")
+	require.NoError(t, err)
+
+	nested := map[interface{}]interface{}{
+		"log": "request from 10.0.0.1",
+		"content": map[interface{}]interface{}{
+			"user":   "jane.doe@example.com",
+			"card":   int64(4111111111111111),
+			"status": int64(200),
+			"ok":     true,
+			"ips":    []interface{}{"10.0.0.2", "jane.doe@example.com", int64(1)},
+		},
+		"user": "jane.doe@example.com",
+	}
+
+	counts := make([]int, len(r.Rules()))
+	r.RedactNested(nested, flatten.Options{Separator: "."}, counts)
+
+	require.Equal(t, map[interface{}]interface{}{
+		"log": "request from [REDACTED]",
+		"content": map[interface{}]interface{}{
+			"card":   "[REDACTED]",
+			"status": int64(200),
+			"ok":     true,
+			"ips":    []interface{}{"[REDACTED]", int64(1)},
+		},
+		"user": "jane.doe@example.com",
+	}, nested)
+	require.Equal(t, []int{2, 2, 1}, counts)
+}
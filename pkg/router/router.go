@@ -0,0 +1,148 @@
+package router
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Rule is a single routing rule. If the Field is empty the Pattern is matched
+// against the tag of a record, otherwise it is matched against the value of
+// the flattened field with the name Field. When the Pattern matches, the record
+// is written to the Table of the rule.
+type Rule struct {
+	Field   string
+	Pattern string
+	Table   string
+}
+
+// Router selects the table, to which a record should be written. The rules of
+// the router are evaluated in the order they were defined and the first
+// matching rule wins. If no rule matches a record, the default table is used.
+type Router struct {
+	rules        []Rule
+	defaultTable string
+}
+
+// Route returns the table for a record with the provided tag and flattened
+// fields.
+func (r *Router) Route(tag string, fields map[string]interface{}) string {
+	for _, rule := range r.rules {
+		value := tag
+
+		if rule.Field != "" {
+			fieldValue, ok := fields[rule.Field]
+			if !ok || fieldValue == nil {
+				continue
+			}
+
+			switch v := fieldValue.(type) {
+			case string:
+				value = v
+			case []byte:
+				value = string(v)
+			default:
+				value = fmt.Sprintf("%v", v)
+			}
+		}
+
+		if matched, _ := path.Match(rule.Pattern, value); matched {
+			return rule.Table
+		}
+	}
+
+	return r.defaultTable
+}
+
+// Fields returns the names of all fields, which are used by the rules of the
+// router.
+func (r *Router) Fields() []string {
+	var fields []string
+	for _, rule := range r.rules {
+		if rule.Field != "" {
+			fields = append(fields, rule.Field)
+		}
+	}
+	return fields
+}
+
+// Tables returns the names of all tables, which can be returned by the router.
+// The default table is always the first table in the returned list.
+func (r *Router) Tables() []string {
+	tables := []string{r.defaultTable}
+
+	for _, rule := range r.rules {
+		if !contains(rule.Table, tables) {
+			tables = append(tables, rule.Table)
+		}
+	}
+
+	return tables
+}
+
+func contains(table string, tables []string) bool {
+	for _, t := range tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRule parses a single routing rule. A rule has the format
+// "<pattern> => <table>" to match the tag of a record or the format
+// "<field>=<pattern> => <table>" to match the value of a flattened field.
+func parseRule(rule string) (Rule, error) {
+	parts := strings.Split(rule, "=>")
+	if len(parts) != 2 {
+		return Rule{}, fmt.Errorf("invalid route %q: must have the format \"<pattern> => <table>\" or \"<field>=<pattern> => <table>\"", rule)
+	}
+
+	var field string
+	pattern := strings.TrimSpace(parts[0])
+	table := strings.TrimSpace(parts[1])
+
+	if before, after, found := strings.Cut(pattern, "="); found {
+		field = strings.TrimSpace(before)
+		pattern = strings.TrimSpace(after)
+
+		if field == "" {
+			return Rule{}, fmt.Errorf("invalid route %q: field is required", rule)
+		}
+	}
+
+	if pattern == "" || table == "" {
+		return Rule{}, fmt.Errorf("invalid route %q: pattern and table are required", rule)
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return Rule{}, fmt.Errorf("invalid route %q: %w", rule, err)
+	}
+
+	return Rule{Field: field, Pattern: pattern, Table: table}, nil
+}
+
+// New returns a new router for the provided comma separated list of routing
+// rules. Records which are not matched by any rule are routed to the provided
+// default table.
+func New(routes, defaultTable string) (*Router, error) {
+	var rules []Rule
+
+	for _, route := range strings.Split(routes, ",") {
+		if strings.TrimSpace(route) == "" {
+			continue
+		}
+
+		rule, err := parseRule(route)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return &Router{
+		rules:        rules,
+		defaultTable: defaultTable,
+	}, nil
+}
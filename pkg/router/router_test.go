@@ -0,0 +1,57 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should succeed without routes", func(t *testing.T) {
+		r, err := New("", "logs")
+		require.NoError(t, err)
+		require.Empty(t, r.rules)
+		require.Equal(t, []string{"logs"}, r.Tables())
+	})
+
+	t.Run("should succeed with valid routes", func(t *testing.T) {
+		r, err := New("kube.var.log.containers.ingress-* => ingress_logs, kubernetes_namespace_name=audit => audit_logs,kube.audit.* => audit_logs", "logs")
+		require.NoError(t, err)
+		require.Equal(t, []Rule{
+			{Pattern: "kube.var.log.containers.ingress-*", Table: "ingress_logs"},
+			{Field: "kubernetes_namespace_name", Pattern: "audit", Table: "audit_logs"},
+			{Pattern: "kube.audit.*", Table: "audit_logs"},
+		}, r.rules)
+		require.Equal(t, []string{"logs", "ingress_logs", "audit_logs"}, r.Tables())
+	})
+
+	for _, routes := range []string{"kube.*", "kube.* =>", "=> logs", "=audit => audit_logs", "kube.[ => logs", "a => b => c"} {
+		t.Run("should fail for "+routes, func(t *testing.T) {
+			_, err := New(routes, "logs")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	r, err := New("kube.var.log.containers.ingress-* => ingress_logs, kubernetes_namespace_name=audit* => audit_logs, status=5* => error_logs", "logs")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name     string
+		tag      string
+		fields   map[string]interface{}
+		expected string
+	}{
+		{name: "should match tag", tag: "kube.var.log.containers.ingress-nginx-1234.log", fields: map[string]interface{}{"kubernetes_namespace_name": "audit"}, expected: "ingress_logs"},
+		{name: "should match string field", tag: "kube.var.log.containers.app.log", fields: map[string]interface{}{"kubernetes_namespace_name": "audit-system"}, expected: "audit_logs"},
+		{name: "should match bytes field", tag: "kube.var.log.containers.app.log", fields: map[string]interface{}{"kubernetes_namespace_name": []byte("audit")}, expected: "audit_logs"},
+		{name: "should match number field", tag: "kube.var.log.containers.app.log", fields: map[string]interface{}{"status": int64(503)}, expected: "error_logs"},
+		{name: "should ignore nil field", tag: "kube.var.log.containers.app.log", fields: map[string]interface{}{"kubernetes_namespace_name": nil}, expected: "logs"},
+		{name: "should use default table", tag: "kube.var.log.containers.app.log", fields: map[string]interface{}{"kubernetes_namespace_name": "default"}, expected: "logs"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, r.Route(tt.tag, tt.fields))
+		})
+	}
+}
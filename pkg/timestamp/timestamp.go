@@ -0,0 +1,195 @@
+package timestamp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	// The timezone database is embedded, because the Fluent Bit image doesn't
+	// contain it.
+	_ "time/tzdata"
+)
+
+// The following formats can be used to parse the timestamp of a record. All
+// other formats are used as layout for the time.Parse function.
+const (
+	FormatRFC3339     = "rfc3339"
+	FormatRFC3339Nano = "rfc3339nano"
+	FormatRFC1123     = "rfc1123"
+	FormatRFC1123Z    = "rfc1123z"
+	FormatEpoch       = "epoch"
+	FormatEpochMillis = "epoch_millis"
+	FormatEpochMicros = "epoch_micros"
+	FormatEpochNanos  = "epoch_nanos"
+)
+
+// The following fallback policies define which timestamp is used, when the
+// timestamp of a record can not be parsed or when the record doesn't contain
+// the time key.
+const (
+	// FallbackEventTime uses the event time of Fluent Bit. This is the default
+	// fallback policy.
+	FallbackEventTime = "event_time"
+	// FallbackNow uses the current time.
+	FallbackNow = "now"
+	// FallbackDrop drops the record.
+	FallbackDrop = "drop"
+)
+
+// DefaultFormats are the formats, which are used when no format is configured.
+var DefaultFormats = []string{FormatRFC3339Nano, FormatEpoch}
+
+// layouts maps the named formats to the layouts of the time package.
+var layouts = map[string]string{
+	FormatRFC3339:     time.RFC3339,
+	FormatRFC3339Nano: time.RFC3339Nano,
+	FormatRFC1123:     time.RFC1123,
+	FormatRFC1123Z:    time.RFC1123Z,
+}
+
+// Parser parses the timestamp of a record from the value of a field. The
+// formats are tried in the defined order and the result of the first matching
+// format is used.
+type Parser struct {
+	formats  []string
+	location *time.Location
+}
+
+// Parse parses the provided value of a field with the formats of the parser.
+// The value can be a string or a number. Layouts without timezone information
+// are interpreted in the configured timezone.
+func (p *Parser) Parse(value interface{}) (time.Time, error) {
+	for _, format := range p.formats {
+		if t, ok := p.parse(format, value); ok {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("failed to parse %v with formats %s", value, strings.Join(p.formats, ", "))
+}
+
+func (p *Parser) parse(format string, value interface{}) (time.Time, bool) {
+	switch format {
+	case FormatEpoch:
+		return parseEpoch(value, 1e9)
+	case FormatEpochMillis:
+		return parseEpoch(value, 1e6)
+	case FormatEpochMicros:
+		return parseEpoch(value, 1e3)
+	case FormatEpochNanos:
+		return parseEpoch(value, 1)
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return time.Time{}, false
+	}
+
+	layout, ok := layouts[format]
+	if !ok {
+		layout = format
+	}
+
+	t, err := time.ParseInLocation(layout, s, p.location)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// parseEpoch parses a number or a numeric string as epoch timestamp, where
+// nanoseconds is the number of nanoseconds of one unit of the value.
+func parseEpoch(value interface{}, nanoseconds int64) (time.Time, bool) {
+	switch v := value.(type) {
+	case int64:
+		return fromUnit(v, nanoseconds), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return time.Time{}, false
+		}
+		return fromUnit(int64(v), nanoseconds), true
+	case float64:
+		return fromFloat(v, nanoseconds)
+	case float32:
+		return fromFloat(float64(v), nanoseconds)
+	case string:
+		return parseEpochString(v, nanoseconds)
+	case []byte:
+		return parseEpochString(string(v), nanoseconds)
+	default:
+		return time.Time{}, false
+	}
+}
+
+func parseEpochString(s string, nanoseconds int64) (time.Time, bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return fromUnit(i, nanoseconds), true
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return fromFloat(f, nanoseconds)
+	}
+
+	return time.Time{}, false
+}
+
+// fromUnit returns the time for an integer value, so that we do not lose
+// precision for epoch nanoseconds.
+func fromUnit(v, nanoseconds int64) time.Time {
+	unitsPerSecond := int64(1e9) / nanoseconds
+	return time.Unix(v/unitsPerSecond, (v%unitsPerSecond)*nanoseconds)
+}
+
+func fromFloat(v float64, nanoseconds int64) (time.Time, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return time.Time{}, false
+	}
+
+	sec, frac := math.Modf(v * float64(nanoseconds) / 1e9)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// New returns a new parser for the provided comma separated list of formats
+// and the timezone. If no formats are provided, the DefaultFormats are used
+// and if no timezone is provided, UTC is used.
+func New(formats, timezone string) (*Parser, error) {
+	p := &Parser{location: time.UTC}
+
+	for _, format := range strings.Split(formats, ",") {
+		if format = strings.TrimSpace(format); format != "" {
+			p.formats = append(p.formats, format)
+		}
+	}
+
+	if len(p.formats) == 0 {
+		p.formats = DefaultFormats
+	}
+
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", timezone, err)
+		}
+		p.location = location
+	}
+
+	return p, nil
+}
+
+// ValidateFallback validates the provided fallback policy.
+func ValidateFallback(fallback string) error {
+	switch fallback {
+	case FallbackEventTime, FallbackNow, FallbackDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid fallback %q: must be %q, %q or %q", fallback, FallbackEventTime, FallbackNow, FallbackDrop)
+	}
+}
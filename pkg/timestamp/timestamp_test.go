@@ -0,0 +1,81 @@
+package timestamp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should use default formats and utc", func(t *testing.T) {
+		p, err := New("", "")
+		require.NoError(t, err)
+		require.Equal(t, DefaultFormats, p.formats)
+		require.Equal(t, time.UTC, p.location)
+	})
+
+	t.Run("should parse formats and timezone", func(t *testing.T) {
+		p, err := New("epoch_millis, 2006-01-02 15:04:05", "Europe/Berlin")
+		require.NoError(t, err)
+		require.Equal(t, []string{FormatEpochMillis, "2006-01-02 15:04:05"}, p.formats)
+		require.Equal(t, "Europe/Berlin", p.location.String())
+	})
+
+	t.Run("should fail for invalid timezone", func(t *testing.T) {
+		_, err := New("", "Invalid/Timezone")
+		require.Error(t, err)
+	})
+}
+
+func TestParse(t *testing.T) {
+	expected := time.Date(2023, 11, 14, 22, 13, 20, 123456789, time.UTC)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		formats  string
+		timezone string
+		value    interface{}
+		expected time.Time
+	}{
+		{name: "rfc3339nano", formats: "", value: "2023-11-14T22:13:20.123456789Z", expected: expected},
+		{name: "rfc3339 with offset", formats: FormatRFC3339, value: "2023-11-14T23:13:20.123456789+01:00", expected: expected},
+		{name: "epoch seconds", formats: "", value: int64(1700000000), expected: expected.Truncate(time.Second)},
+		{name: "epoch seconds as float", formats: FormatEpoch, value: float64(1700000000.5), expected: time.Unix(1700000000, 500000000)},
+		{name: "epoch seconds as string", formats: FormatEpoch, value: "1700000000", expected: expected.Truncate(time.Second)},
+		{name: "epoch millis", formats: FormatEpochMillis, value: uint64(1700000000123), expected: expected.Truncate(time.Millisecond)},
+		{name: "epoch micros", formats: FormatEpochMicros, value: "1700000000123456", expected: expected.Truncate(time.Microsecond)},
+		{name: "epoch nanos", formats: FormatEpochNanos, value: int64(1700000000123456789), expected: expected},
+		{name: "custom layout in timezone", formats: "2006-01-02 15:04:05", timezone: "Europe/Berlin", value: "2023-11-14 23:13:20", expected: time.Date(2023, 11, 14, 23, 13, 20, 0, berlin)},
+		{name: "second format", formats: "rfc3339, epoch_millis", value: int64(1700000000123), expected: expected.Truncate(time.Millisecond)},
+		{name: "bytes", formats: FormatRFC3339Nano, value: []byte("2023-11-14T22:13:20.123456789Z"), expected: expected},
+	} {
+		t.Run("should parse "+tc.name, func(t *testing.T) {
+			p, err := New(tc.formats, tc.timezone)
+			require.NoError(t, err)
+
+			actual, err := p.Parse(tc.value)
+			require.NoError(t, err)
+			require.True(t, tc.expected.Equal(actual), "expected %s, got %s", tc.expected, actual)
+		})
+	}
+
+	t.Run("should fail for invalid values", func(t *testing.T) {
+		p, err := New("", "")
+		require.NoError(t, err)
+
+		for _, value := range []interface{}{"invalid", true, map[interface{}]interface{}{}} {
+			_, err := p.Parse(value)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestValidateFallback(t *testing.T) {
+	require.NoError(t, ValidateFallback(FallbackEventTime))
+	require.NoError(t, ValidateFallback(FallbackNow))
+	require.NoError(t, ValidateFallback(FallbackDrop))
+	require.Error(t, ValidateFallback("invalid"))
+}
@@ -0,0 +1,362 @@
+// Package wal implements a simple write-ahead log, which is used to persist the
+// buffered rows of the ClickHouse client on disk. The log is split into
+// multiple segments, so that the rows which were written to ClickHouse can be
+// removed from the log by deleting the corresponding segments.
+//
+// Each record in a segment is prefixed by its length and a CRC32 checksum of
+// the record. When a segment is read and a record can not be read completely or
+// the checksum doesn't match, the rest of the segment is ignored. This can
+// happen when the process crashes while a record is written.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExtension = ".wal"
+	headerSize       = 8
+)
+
+// ErrFull is returned by Append, when the record can not be written, because
+// the log would exceed its maximum size.
+var ErrFull = errors.New("write-ahead log is full")
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// WAL is a write-ahead log, which stores records in multiple segment files in
+// a directory. A WAL must be created via the Open function.
+type WAL struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mutex    sync.Mutex
+	segments []segment
+	file     *os.File
+	size     int64
+}
+
+// Append appends the provided records to the current segment of the log. If the
+// records would exceed the maximum size of the log, none of the records is
+// appended and ErrFull is returned. If the current segment exceeds the
+// configured segment size, a new segment is created. Append doesn't sync the
+// segment to disk, this must be done via the Sync method.
+func (w *WAL) Append(records ...[]byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.fits(records...) {
+		return ErrFull
+	}
+
+	for _, record := range records {
+		if w.segments[len(w.segments)-1].size >= w.segmentSize {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+
+		recordSize := int64(headerSize + len(record))
+
+		buf := make([]byte, recordSize)
+		binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+		binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+		copy(buf[headerSize:], record)
+
+		if _, err := w.file.Write(buf); err != nil {
+			return err
+		}
+
+		w.segments[len(w.segments)-1].size += recordSize
+		w.size += recordSize
+	}
+
+	return nil
+}
+
+// Fits returns true, when the provided records can be appended to the log
+// without exceeding the maximum size of the log.
+func (w *WAL) Fits(records ...[]byte) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.fits(records...)
+}
+
+func (w *WAL) fits(records ...[]byte) bool {
+	if w.maxSize <= 0 {
+		return true
+	}
+
+	size := w.size
+	for _, record := range records {
+		size = size + int64(headerSize+len(record))
+	}
+
+	return size <= w.maxSize
+}
+
+// Sync commits the current segment to disk.
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Sync()
+}
+
+// Position is the position in the log after the last appended record. It can
+// be passed to Reset, to remove all records which were appended afterwards.
+type Position struct {
+	segment uint64
+	size    int64
+}
+
+// Position returns the current position in the log.
+func (w *WAL) Position() Position {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return Position{segment: w.segments[len(w.segments)-1].id, size: w.segments[len(w.segments)-1].size}
+}
+
+// Reset removes all records, which were appended after the provided position,
+// e.g. when the records of a failed Append should not be replayed. All
+// segments which were created after the position are removed and the segment
+// of the position becomes the current segment again.
+func (w *WAL) Reset(position Position) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	i := sort.Search(len(w.segments), func(i int) bool {
+		return w.segments[i].id >= position.segment
+	})
+	if i == len(w.segments) || w.segments[i].id != position.segment {
+		return fmt.Errorf("segment %d does not exist", position.segment)
+	}
+
+	for _, s := range w.segments[i+1:] {
+		if err := os.Remove(w.segmentPath(s.id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		w.size -= s.size
+	}
+	w.segments = w.segments[:i+1]
+
+	file, err := os.OpenFile(w.segmentPath(position.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Truncate(position.size); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = file
+	w.size -= w.segments[i].size - position.size
+	w.segments[i].size = position.size
+
+	return nil
+}
+
+// Rotate closes the current segment and creates a new one. It returns the id
+// of the closed segment, which can be passed to Truncate, to remove all records
+// which were appended before Rotate was called.
+func (w *WAL) Rotate() (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	id := w.segments[len(w.segments)-1].id
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (w *WAL) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	id := w.segments[len(w.segments)-1].id + 1
+
+	file, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.segments = append(w.segments, segment{id: id})
+
+	return nil
+}
+
+// Truncate removes all segments with an id lower or equal to the provided id.
+// The current segment is never removed.
+func (w *WAL) Truncate(id uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for len(w.segments) > 1 && w.segments[0].id <= id {
+		if err := os.Remove(w.segmentPath(w.segments[0].id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		w.size -= w.segments[0].size
+		w.segments = w.segments[1:]
+	}
+
+	return nil
+}
+
+// Replay calls the provided function for each record in the log, starting with
+// the oldest record. If the function returns an error, the replay is stopped
+// and the error is returned.
+func (w *WAL) Replay(fn func(record []byte) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, s := range w.segments {
+		if err := w.replaySegment(s.id, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WAL) replaySegment(id uint64, fn func(record []byte) error) error {
+	file, err := os.Open(w.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil
+		}
+
+		record := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return nil
+		}
+
+		if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+			return nil
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Size returns the size of all segments of the log in bytes.
+func (w *WAL) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.size
+}
+
+// Close closes the current segment of the log.
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", id, segmentExtension))
+}
+
+// Open opens the write-ahead log in the provided directory. If the directory
+// doesn't exist it is created. All existing segments are kept, so that they
+// can be replayed via the Replay method. New records are always appended to a
+// new segment.
+//
+// The maxSize is the maximum size of all segments in bytes. If it is 0, the
+// size of the log is not limited. The segmentSize is the size in bytes after
+// which a new segment is created.
+func Open(dir string, maxSize, segmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExtension) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		w.segments = append(w.segments, segment{id: id, size: info.Size()})
+		w.size += info.Size()
+	}
+
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].id < w.segments[j].id
+	})
+
+	var id uint64
+	if len(w.segments) > 0 {
+		id = w.segments[len(w.segments)-1].id + 1
+	}
+
+	file, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w.file = file
+	w.segments = append(w.segments, segment{id: id})
+
+	return w, nil
+}
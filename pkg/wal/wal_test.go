@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func replay(t *testing.T, w *WAL) []string {
+	var records []string
+
+	err := w.Replay(func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	require.NoError(t, err)
+
+	return records
+}
+
+func TestWAL(t *testing.T) {
+	t.Run("should replay records after reopen", func(t *testing.T) {
+		dir := t.TempDir()
+
+		w, err := Open(dir, 0, 1024)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+		require.NoError(t, w.Append([]byte("record2")))
+		require.NoError(t, w.Sync())
+		require.NoError(t, w.Close())
+
+		w, err = Open(dir, 0, 1024)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record3")))
+		require.Equal(t, []string{"record1", "record2", "record3"}, replay(t, w))
+		require.Equal(t, int64(3*(headerSize+7)), w.Size())
+		require.NoError(t, w.Close())
+	})
+
+	t.Run("should create new segments", func(t *testing.T) {
+		dir := t.TempDir()
+
+		w, err := Open(dir, 0, headerSize+7)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+		require.NoError(t, w.Append([]byte("record2")))
+		require.NoError(t, w.Close())
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+
+	t.Run("should truncate rotated segments", func(t *testing.T) {
+		w, err := Open(t.TempDir(), 0, 1024)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+
+		id, err := w.Rotate()
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record2")))
+		require.NoError(t, w.Truncate(id))
+		require.Equal(t, []string{"record2"}, replay(t, w))
+		require.Equal(t, int64(headerSize+7), w.Size())
+		require.NoError(t, w.Close())
+	})
+
+	t.Run("should return error when log is full", func(t *testing.T) {
+		w, err := Open(t.TempDir(), 2*(headerSize+7), 1024)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+		require.False(t, w.Fits([]byte("record2"), []byte("record3")))
+		require.ErrorIs(t, w.Append([]byte("record2"), []byte("record3")), ErrFull)
+		require.True(t, w.Fits([]byte("record2")))
+		require.NoError(t, w.Append([]byte("record2")))
+		require.ErrorIs(t, w.Append([]byte("record3")), ErrFull)
+		require.Equal(t, []string{"record1", "record2"}, replay(t, w))
+		require.NoError(t, w.Close())
+	})
+
+	t.Run("should reset to position", func(t *testing.T) {
+		dir := t.TempDir()
+
+		w, err := Open(dir, 0, headerSize+7)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+
+		position := w.Position()
+		require.NoError(t, w.Append([]byte("record2"), []byte("record3")))
+		require.NoError(t, w.Reset(position))
+		require.Equal(t, []string{"record1"}, replay(t, w))
+		require.Equal(t, int64(headerSize+7), w.Size())
+
+		require.NoError(t, w.Append([]byte("record4")))
+		require.NoError(t, w.Close())
+
+		w, err = Open(dir, 0, 1024)
+		require.NoError(t, err)
+		require.Equal(t, []string{"record1", "record4"}, replay(t, w))
+		require.NoError(t, w.Close())
+	})
+
+	t.Run("should ignore incomplete records", func(t *testing.T) {
+		dir := t.TempDir()
+
+		w, err := Open(dir, 0, 1024)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte("record1")))
+		require.NoError(t, w.Append([]byte("record2")))
+		require.NoError(t, w.Close())
+
+		path := filepath.Join(dir, "00000000000000000000.wal")
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()-3))
+
+		w, err = Open(dir, 0, 1024)
+		require.NoError(t, err)
+		require.Equal(t, []string{"record1"}, replay(t, w))
+		require.NoError(t, w.Close())
+	})
+}